@@ -0,0 +1,117 @@
+package redirecterrors
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// defaultBodyBufferSize the default maximum number of bytes of an upstream body buffered for body matching.
+const defaultBodyBufferSize = 64 * 1024
+
+// BodyMatch a condition on the upstream response body, checked in addition to the status or header triggers.
+// JSONPointer selects a value of a JSON body (RFC 6901); Value is compared with it, or with the whole body
+// when there is no pointer. A Value prefixed with "regex:" is a regular expression.
+// A pointer without a value only requires the selected value to exist.
+type BodyMatch struct {
+	JSONPointer string `json:"jsonPointer,omitempty"`
+	Value       string `json:"value,omitempty"`
+}
+
+// bodyMatcher a compiled body match.
+type bodyMatcher struct {
+	pointer []string
+	value   string
+	pattern *regexp.Regexp
+}
+
+// newBodyMatcher compiles a body match. It returns nil when match is nil.
+func newBodyMatcher(match *BodyMatch) (*bodyMatcher, error) {
+	if match == nil {
+		return nil, nil
+	}
+	if len(match.JSONPointer) == 0 && len(match.Value) == 0 {
+		return nil, fmt.Errorf("body match needs a jsonPointer or a value")
+	}
+
+	m := &bodyMatcher{value: match.Value}
+	if len(match.JSONPointer) != 0 {
+		if match.JSONPointer[0] != '/' {
+			return nil, fmt.Errorf("invalid JSON pointer '%s'", match.JSONPointer)
+		}
+		for _, token := range strings.Split(match.JSONPointer[1:], "/") {
+			m.pointer = append(m.pointer, strings.NewReplacer("~1", "/", "~0", "~").Replace(token))
+		}
+	}
+	if strings.HasPrefix(match.Value, regexPathPrefix) {
+		re, err := regexp.Compile(strings.TrimPrefix(match.Value, regexPathPrefix))
+		if err != nil {
+			return nil, fmt.Errorf("invalid body match pattern '%s': %w", match.Value, err)
+		}
+		m.pattern = re
+	}
+	return m, nil
+}
+
+// matches returns whether the body satisfies the match.
+func (m *bodyMatcher) matches(body []byte) bool {
+	value := string(body)
+	if m.pointer != nil {
+		var ok bool
+		value, ok = jsonPointerValue(body, m.pointer)
+		if !ok {
+			return false
+		}
+		if len(m.value) == 0 {
+			return true
+		}
+	}
+
+	if m.pattern != nil {
+		return m.pattern.MatchString(value)
+	}
+	return value == m.value
+}
+
+// jsonPointerValue returns the value selected by the pointer tokens in a JSON document.
+// Strings are returned as is, other values in their JSON encoding.
+func jsonPointerValue(body []byte, pointer []string) (string, bool) {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return "", false
+	}
+
+	for _, token := range pointer {
+		switch node := value.(type) {
+		case map[string]interface{}:
+			child, ok := node[token]
+			if !ok {
+				return "", false
+			}
+			value = child
+		case []interface{}:
+			index, err := strconv.Atoi(token)
+			if err != nil || index < 0 || index >= len(node) || strconv.Itoa(index) != token {
+				return "", false
+			}
+			value = node[index]
+		default:
+			return "", false
+		}
+	}
+
+	if s, ok := value.(string); ok {
+		return s, true
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return "", false
+	}
+	return string(encoded), true
+}
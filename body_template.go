@@ -0,0 +1,79 @@
+package redirecterrors
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"mime"
+	"os"
+	"strings"
+)
+
+// defaultBody the body of the redirect response when no template is configured.
+const defaultBody = "Redirecting"
+
+// bodyTemplate the body written with the redirect response.
+// It uses the same placeholders as targets, plus {location} for the final redirect location.
+type bodyTemplate struct {
+	template    *template
+	contentType string
+	escape      func(string) string
+}
+
+// newBodyTemplate creates the body template from an inline template or a template file.
+// It returns nil when neither is configured.
+func newBodyTemplate(body, bodyFile, contentType string) (*bodyTemplate, error) {
+	if len(body) != 0 && len(bodyFile) != 0 {
+		return nil, fmt.Errorf("outputBody and outputBodyFile are mutually exclusive")
+	}
+
+	if len(bodyFile) != 0 {
+		content, err := os.ReadFile(bodyFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading body template file: %w", err)
+		}
+		body = string(content)
+	}
+
+	if len(body) == 0 {
+		return nil, nil
+	}
+
+	compiled, err := compileBodyTemplate(body, "location")
+	if err != nil {
+		return nil, fmt.Errorf("body template: %w", err)
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, fmt.Errorf("invalid output content type '%s': %w", contentType, err)
+	}
+
+	bt := &bodyTemplate{
+		template:    compiled,
+		contentType: contentType,
+	}
+	switch {
+	case mediaType == "text/html" || mediaType == "application/xhtml+xml":
+		bt.escape = html.EscapeString
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		bt.escape = escapeJSONString
+	}
+	return bt, nil
+}
+
+// escapeJSONString escapes s for use within a JSON string literal.
+func escapeJSONString(s string) string {
+	quoted, err := json.Marshal(s)
+	if err != nil {
+		return ""
+	}
+	return string(quoted[1 : len(quoted)-1])
+}
+
+// render expands the template. Values are HTML-escaped for HTML content types,
+// and escaped as JSON string contents for JSON content types.
+func (bt *bodyTemplate) render(values placeholders, location string) string {
+	values.values["location"] = location
+	return bt.template.render(values, bt.escape)
+}
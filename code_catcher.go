@@ -4,30 +4,42 @@ package redirecterrors
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"net"
 	"net/http"
 )
 
 // codeCatcher is a response writer that detects as soon as possible
-// whether the response is a code within the ranges of codes it watches for.
+// whether the response is a code within the ranges of codes it watches for,
+// or has headers matching one of its header triggers.
 // If it is, it simply drops the data from the response.
 // Otherwise, it forwards it directly to the original client (its responseWriter) without any buffering.
+// When body buffering is enabled for the caught response, its body is kept, up to a limit, instead of dropped.
 type codeCatcher struct {
 	headerMap          http.Header
 	code               int
 	httpCodeRanges     HTTPCodeRanges
+	headerTriggers     []*headerTrigger
 	caughtFilteredCode bool
 	responseWriter     http.ResponseWriter
 	headersSent        bool
+	hijacked           bool
+	bufferRanges       HTTPCodeRanges
+	bufferTriggers     []*headerTrigger
+	bufferLimit        int
+	buffering          bool
+	bufferOverflowed   bool
+	body               bytes.Buffer
 }
 
-func newCodeCatcher(rw http.ResponseWriter, httpCodeRanges HTTPCodeRanges) *codeCatcher {
+func newCodeCatcher(rw http.ResponseWriter, httpCodeRanges HTTPCodeRanges, headerTriggers []*headerTrigger) *codeCatcher {
 	return &codeCatcher{
 		headerMap:      make(http.Header),
 		code:           http.StatusOK, // If backend does not call WriteHeader on us, we consider it's a 200.
 		responseWriter: rw,
 		httpCodeRanges: httpCodeRanges,
+		headerTriggers: headerTriggers,
 	}
 }
 
@@ -53,6 +65,28 @@ func (cc *codeCatcher) isFilteredCode() bool {
 	return cc.caughtFilteredCode
 }
 
+// bufferBodies enables buffering the body of caught responses whose code is within httpCodeRanges,
+// or whose headers match one of headerTriggers, up to limit bytes.
+func (cc *codeCatcher) bufferBodies(httpCodeRanges HTTPCodeRanges, headerTriggers []*headerTrigger, limit int) {
+	cc.bufferRanges = httpCodeRanges
+	cc.bufferTriggers = headerTriggers
+	cc.bufferLimit = limit
+}
+
+// getBody returns the buffered body of the caught response, or nil when it was not buffered.
+func (cc *codeCatcher) getBody() []byte {
+	if !cc.buffering {
+		return nil
+	}
+	return cc.body.Bytes()
+}
+
+// isBufferOverflowed returns whether the caught response was sent to the client
+// because its body exceeded the buffer limit.
+func (cc *codeCatcher) isBufferOverflowed() bool {
+	return cc.bufferOverflowed
+}
+
 // getHeaders returns the headers that were set by the upstream handler.
 func (cc *codeCatcher) getHeaders() http.Header {
 	return cc.headerMap
@@ -64,6 +98,16 @@ func (cc *codeCatcher) Write(buf []byte) (int, error) {
 	cc.WriteHeader(cc.code)
 
 	if cc.caughtFilteredCode {
+		if cc.buffering {
+			if cc.body.Len()+len(buf) > cc.bufferLimit {
+				// The body cannot be matched within the limit, stream the response as is
+				cc.bufferOverflowed = true
+				cc.passThrough()
+				return cc.responseWriter.Write(buf)
+			}
+			return cc.body.Write(buf)
+		}
+
 		// We don't care about the contents of the response,
 		// since we want to serve the ones from the error page,
 		// so we just drop them.
@@ -75,7 +119,7 @@ func (cc *codeCatcher) Write(buf []byte) (int, error) {
 // WriteHeader is, in the specific case of 1xx status codes, a direct call to the wrapped ResponseWriter, without marking headers as sent,
 // allowing so further calls.
 func (cc *codeCatcher) WriteHeader(code int) {
-	if cc.headersSent || cc.caughtFilteredCode {
+	if cc.headersSent || cc.caughtFilteredCode || cc.hijacked {
 		return
 	}
 
@@ -92,13 +136,13 @@ func (cc *codeCatcher) WriteHeader(code int) {
 	}
 
 	cc.code = code
-	for _, block := range cc.httpCodeRanges {
-		if cc.code >= block[0] && cc.code <= block[1] {
-			cc.caughtFilteredCode = true
-			// it will be up to the caller to send the headers,
-			// so it is out of our hands now.
-			return
-		}
+	if cc.httpCodeRanges.Contains(cc.code) || anyHeaderTriggerMatches(cc.headerTriggers, cc.Header()) {
+		cc.caughtFilteredCode = true
+		cc.buffering = cc.bufferLimit > 0 &&
+			(cc.bufferRanges.Contains(cc.code) || anyHeaderTriggerMatches(cc.bufferTriggers, cc.Header()))
+		// it will be up to the caller to send the headers,
+		// so it is out of our hands now.
+		return
 	}
 
 	// The copy is not appending the values,
@@ -111,11 +155,24 @@ func (cc *codeCatcher) WriteHeader(code int) {
 }
 
 // Hijack hijacks the connection.
+// A caught response is answered by the middleware, so its connection cannot be hijacked.
+// Once hijacked, the connection belongs to the caller and nothing more is written to it.
 func (cc *codeCatcher) Hijack() (net.Conn, *bufio.ReadWriter, error) {
-	if hj, ok := cc.responseWriter.(http.Hijacker); ok {
-		return hj.Hijack()
+	if cc.caughtFilteredCode {
+		return nil, nil, fmt.Errorf("cannot hijack a response caught with status %d", cc.code)
+	}
+
+	hj, ok := cc.responseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("%T is not a http.Hijacker", cc.responseWriter)
 	}
-	return nil, nil, fmt.Errorf("%T is not a http.Hijacker", cc.responseWriter)
+
+	conn, rw, err := hj.Hijack()
+	if err == nil {
+		cc.hijacked = true
+		cc.headersSent = true
+	}
+	return conn, rw, err
 }
 
 // Flush sends any buffered data to the client.
@@ -129,7 +186,7 @@ func (cc *codeCatcher) Flush() {
 	// so we just don't flush.
 	// (e.g., To prevent superfluous WriteHeader on request with a
 	// `Transfert-Encoding: chunked` header).
-	if cc.caughtFilteredCode {
+	if cc.caughtFilteredCode || cc.hijacked {
 		return
 	}
 
@@ -137,3 +194,26 @@ func (cc *codeCatcher) Flush() {
 		flusher.Flush()
 	}
 }
+
+// passThrough sends the caught status and headers to the client.
+// When its body was buffered, it is replayed along with the upstream entity headers.
+// Otherwise the body has been dropped, so the headers describing it are removed.
+func (cc *codeCatcher) passThrough() {
+	for k, v := range cc.headerMap {
+		cc.responseWriter.Header()[k] = v
+	}
+	if !cc.buffering {
+		for _, key := range entityHeaders {
+			cc.responseWriter.Header().Del(key)
+		}
+	}
+	cc.responseWriter.WriteHeader(cc.code)
+	cc.headersSent = true
+	cc.caughtFilteredCode = false
+
+	if cc.buffering {
+		cc.buffering = false
+		_, _ = cc.responseWriter.Write(cc.body.Bytes())
+		cc.body.Reset()
+	}
+}
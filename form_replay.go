@@ -0,0 +1,108 @@
+package redirecterrors
+
+import (
+	"bytes"
+	"html"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// maxReplayPostSize the largest form body that fits, once sealed, in the return cookie.
+const maxReplayPostSize = 2048
+
+// maxCookieSize the largest Set-Cookie value browsers are guaranteed to keep.
+const maxCookieSize = 4096
+
+// stashFormBody reads the body of a URL-encoded form POST so it can be replayed after re-authentication.
+// The request body is restored for the upstream. It returns nil when the request is not such a form
+// or its body exceeds maxSize, in which case it is streamed to the upstream as is.
+func stashFormBody(req *http.Request, maxSize int) []byte {
+	if req.Method != http.MethodPost || req.Body == nil || req.Body == http.NoBody {
+		return nil
+	}
+	mediaType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/x-www-form-urlencoded" {
+		return nil
+	}
+	if req.ContentLength > int64(maxSize) {
+		return nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(req.Body, int64(maxSize)+1))
+	if err != nil || len(body) > maxSize {
+		req.Body = readCloser{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+		return nil
+	}
+	req.Body = readCloser{bytes.NewReader(body), req.Body}
+	return body
+}
+
+// isSameOriginRequest returns whether the request was sent by a page of host,
+// according to Sec-Fetch-Site or, when the browser does not send it, Origin or Referer.
+// Replaying a cross-site form after re-authentication would bypass the CSRF defenses of the application.
+func isSameOriginRequest(req *http.Request, host string) bool {
+	if site := req.Header.Get("Sec-Fetch-Site"); len(site) != 0 {
+		return site == "same-origin"
+	}
+
+	source := req.Header.Get("Origin")
+	if len(source) == 0 {
+		source = req.Header.Get("Referer")
+	}
+	u, err := url.Parse(source)
+	if err != nil || len(u.Host) == 0 {
+		return false
+	}
+	return strings.EqualFold(u.Host, host)
+}
+
+// readCloser reads the stashed body, closing the original one.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// writeReplayForm writes a page submitting the stashed form body to action with a POST.
+func writeReplayForm(rw http.ResponseWriter, action, body string) {
+	var inputs strings.Builder
+	for _, field := range strings.Split(body, "&") {
+		if len(field) == 0 {
+			continue
+		}
+		rawName, rawValue, _ := strings.Cut(field, "=")
+		name, err := url.QueryUnescape(rawName)
+		if err != nil {
+			continue
+		}
+		value, err := url.QueryUnescape(rawValue)
+		if err != nil {
+			continue
+		}
+		inputs.WriteString(`<input type="hidden" name="` + html.EscapeString(name) + `" value="` + html.EscapeString(value) + `">` + "\n")
+	}
+
+	page := `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Resubmitting</title>
+</head>
+<body>
+<form method="post" action="` + html.EscapeString(action) + `" enctype="application/x-www-form-urlencoded">
+` + inputs.String() + `<noscript><button type="submit">Continue</button></noscript>
+</form>
+<script>document.forms[0].submit();</script>
+</body>
+</html>
+`
+
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.Header().Set("Content-Length", strconv.Itoa(len(page)))
+	rw.WriteHeader(http.StatusOK)
+	_, _ = io.WriteString(rw, page)
+}
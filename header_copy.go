@@ -0,0 +1,74 @@
+package redirecterrors
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Modes of copying the upstream headers to the redirect response.
+const (
+	copyHeadersAll       = "all"
+	copyHeadersNone      = "none"
+	copyHeadersAllowlist = "allowlist"
+)
+
+// entityHeaders the headers describing the upstream body, which the redirect response replaces.
+var entityHeaders = []string{
+	"Accept-Ranges",
+	"Content-Disposition",
+	"Content-Encoding",
+	"Content-Language",
+	"Content-Length",
+	"Content-Location",
+	"Content-Md5",
+	"Content-Range",
+	"Content-Type",
+	"Etag",
+	"Last-Modified",
+	"Trailer",
+	"Transfer-Encoding",
+}
+
+// headerCopyPolicy decides which upstream headers are copied to the redirect response.
+// Entity headers are never copied, whatever the mode.
+type headerCopyPolicy struct {
+	mode      string
+	allowlist map[string]bool
+}
+
+func newHeaderCopyPolicy(mode string, allowlist []string) (*headerCopyPolicy, error) {
+	switch mode {
+	case copyHeadersAll, copyHeadersNone:
+		if len(allowlist) != 0 {
+			return nil, fmt.Errorf("outputCopyHeadersAllowlist needs outputCopyHeaders '%s'", copyHeadersAllowlist)
+		}
+	case copyHeadersAllowlist:
+	default:
+		return nil, fmt.Errorf("invalid output copy headers mode '%s'", mode)
+	}
+
+	policy := &headerCopyPolicy{mode: mode, allowlist: make(map[string]bool)}
+	for _, name := range allowlist {
+		policy.allowlist[http.CanonicalHeaderKey(name)] = true
+	}
+	return policy, nil
+}
+
+// copy adds the headers of src allowed by the policy to dst.
+func (p *headerCopyPolicy) copy(dst, src http.Header) {
+	if p.mode == copyHeadersNone {
+		return
+	}
+
+	for key, values := range src {
+		if p.mode == copyHeadersAllowlist && !p.allowlist[http.CanonicalHeaderKey(key)] {
+			continue
+		}
+		for _, value := range values {
+			dst.Add(key, value)
+		}
+	}
+	for _, key := range entityHeaders {
+		dst.Del(key)
+	}
+}
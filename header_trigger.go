@@ -0,0 +1,68 @@
+package redirecterrors
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// HeaderTrigger a response header condition triggering a redirect, whatever the status.
+// An empty Value matches any value; a Value prefixed with "regex:" is a regular expression,
+// otherwise values are compared case-insensitively.
+type HeaderTrigger struct {
+	Header string `json:"header,omitempty"`
+	Value  string `json:"value,omitempty"`
+}
+
+// headerTrigger a compiled header trigger.
+type headerTrigger struct {
+	header  string
+	value   string
+	pattern *regexp.Regexp
+}
+
+func newHeaderTriggers(triggers []HeaderTrigger) ([]*headerTrigger, error) {
+	var compiled []*headerTrigger
+	for _, trigger := range triggers {
+		if len(trigger.Header) == 0 {
+			return nil, fmt.Errorf("header trigger needs a header name")
+		}
+
+		t := &headerTrigger{header: http.CanonicalHeaderKey(trigger.Header), value: trigger.Value}
+		if strings.HasPrefix(trigger.Value, regexPathPrefix) {
+			re, err := regexp.Compile(strings.TrimPrefix(trigger.Value, regexPathPrefix))
+			if err != nil {
+				return nil, fmt.Errorf("invalid header trigger pattern '%s': %w", trigger.Value, err)
+			}
+			t.pattern = re
+		}
+		compiled = append(compiled, t)
+	}
+	return compiled, nil
+}
+
+// matches returns whether any value of the trigger's header in h satisfies the trigger.
+func (t *headerTrigger) matches(h http.Header) bool {
+	for _, value := range h.Values(t.header) {
+		switch {
+		case t.pattern != nil:
+			if t.pattern.MatchString(value) {
+				return true
+			}
+		case len(t.value) == 0 || strings.EqualFold(value, t.value):
+			return true
+		}
+	}
+	return false
+}
+
+// anyHeaderTriggerMatches returns whether any of the triggers matches h.
+func anyHeaderTriggerMatches(triggers []*headerTrigger, h http.Header) bool {
+	for _, trigger := range triggers {
+		if trigger.matches(h) {
+			return true
+		}
+	}
+	return false
+}
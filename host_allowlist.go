@@ -0,0 +1,102 @@
+package redirecterrors
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// hostAllowlist holds the hosts that may appear in the reconstructed original URL and the redirect location.
+// Entries are either exact host names or wildcard suffixes such as "*.example.com",
+// which match any subdomain but not the bare domain.
+// An empty allowlist allows every host.
+type hostAllowlist struct {
+	exact    map[string]bool
+	suffixes []string
+}
+
+func newHostAllowlist(entries []string) (*hostAllowlist, error) {
+	allowlist := &hostAllowlist{exact: make(map[string]bool)}
+	for _, entry := range entries {
+		host := strings.ToLower(strings.TrimSpace(entry))
+		if strings.HasPrefix(host, "*.") {
+			if len(host) == 2 {
+				return nil, fmt.Errorf("invalid allowed host '%s'", entry)
+			}
+			allowlist.suffixes = append(allowlist.suffixes, host[1:])
+			continue
+		}
+		if len(host) == 0 || strings.Contains(host, "*") {
+			return nil, fmt.Errorf("invalid allowed host '%s'", entry)
+		}
+		allowlist.exact[host] = true
+	}
+	return allowlist, nil
+}
+
+func (h *hostAllowlist) isEmpty() bool {
+	return len(h.exact) == 0 && len(h.suffixes) == 0
+}
+
+// allows returns whether the host, with or without a port, is allowed.
+func (h *hostAllowlist) allows(host string) bool {
+	if h.isEmpty() {
+		return true
+	}
+
+	host = strings.ToLower(stripPort(host))
+	if h.exact[host] {
+		return true
+	}
+	for _, suffix := range h.suffixes {
+		if strings.HasSuffix(host, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsURL returns whether rawURL may be redirected to.
+// Absolute URLs must use http or https and an allowed host. Relative URLs are allowed
+// when they are absolute paths: a single '/' not followed by another '/' or '\'.
+// Browsers read backslashes as slashes, so they are checked as such.
+func (h *hostAllowlist) allowsURL(rawURL string) bool {
+	if h.isEmpty() {
+		return true
+	}
+
+	normalized := strings.ReplaceAll(rawURL, "\\", "/")
+	u, err := url.Parse(normalized)
+	if err != nil {
+		return false
+	}
+	if len(u.Scheme) == 0 && len(u.Host) == 0 {
+		return strings.HasPrefix(normalized, "/") && !strings.HasPrefix(normalized, "//")
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || len(u.Host) == 0 {
+		return false
+	}
+	return h.allows(u.Host)
+}
+
+// urlHost returns the host of rawURL, read as allowsURL does, for logging a rejected URL without
+// its path and query. URLs without a host give their scheme, such as "javascript:".
+func urlHost(rawURL string) string {
+	u, err := url.Parse(strings.ReplaceAll(rawURL, "\\", "/"))
+	if err != nil {
+		return ""
+	}
+	if len(u.Host) == 0 && len(u.Scheme) != 0 {
+		return u.Scheme + ":"
+	}
+	return u.Host
+}
+
+// stripPort removes the port, if any, from a host.
+func stripPort(host string) string {
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		return hostname
+	}
+	return strings.Trim(host, "[]")
+}
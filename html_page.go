@@ -0,0 +1,65 @@
+package redirecterrors
+
+import (
+	"encoding/json"
+	"html"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Output modes of the redirect response.
+const (
+	outputModeRedirect = "redirect"
+	outputModeHTML     = "html"
+)
+
+// fragmentMarker stands for the original URL fragment in the target expanded for the interstitial page.
+// It only contains characters left untouched by URL escaping, so it survives {uri} and {url}.
+const fragmentMarker = "__REDIRECTERRORS_FRAGMENT__"
+
+// writeHTMLRedirect writes a 200 page that navigates to the location with a script,
+// appending the browser-only location.hash to the return URL.
+// scriptLocation is the target expanded with fragmentMarker appended to the original URL;
+// clients without JavaScript follow location through a meta refresh.
+func writeHTMLRedirect(rw http.ResponseWriter, location, scriptLocation string) {
+	if !strings.Contains(scriptLocation, fragmentMarker) {
+		scriptLocation = location
+	}
+
+	// json.Marshal escapes <, > and &, so the values are safe within a script element
+	target, err := json.Marshal(scriptLocation)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	marker, _ := json.Marshal(fragmentMarker)
+	escapedLocation := html.EscapeString(location)
+
+	page := `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Redirecting</title>
+<script>
+(function () {
+  var target = ` + string(target) + `;
+  var hash = window.location.hash ? encodeURIComponent(window.location.hash) : "";
+  window.location.replace(target.split(` + string(marker) + `).join(hash));
+})();
+</script>
+<noscript><meta http-equiv="refresh" content="0;url=` + escapedLocation + `"></noscript>
+</head>
+<body>
+<p>Redirecting to <a href="` + escapedLocation + `">` + escapedLocation + `</a></p>
+</body>
+</html>
+`
+
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.Header().Set("Content-Length", strconv.Itoa(len(page)))
+	rw.WriteHeader(http.StatusOK)
+	_, _ = io.WriteString(rw, page)
+}
@@ -3,6 +3,8 @@
 package redirecterrors
 
 import (
+	"fmt"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -13,25 +15,133 @@ type HTTPCodeRanges [][2]int
 // NewHTTPCodeRanges creates HTTPCodeRanges from a given []string.
 // Break out the http status code ranges into a low int and high int
 // for ease of use at runtime.
+//
+// Each string holds one or more comma-separated entries: a single code ("404"),
+// a range ("500-503"), a class ("4xx"), or a negation of any of these ("!404")
+// excluding codes from the other entries. Codes must be between 100 and 599.
+// The returned ranges are normalized.
 func NewHTTPCodeRanges(strBlocks []string) (HTTPCodeRanges, error) {
-	var blocks HTTPCodeRanges
-	for _, block := range strBlocks {
-		codes := strings.Split(block, "-")
-		// if only a single HTTP code was configured, assume the best and create the correct configuration on the user's behalf
-		if len(codes) == 1 {
-			codes = append(codes, codes[0])
+	var blocks, excluded HTTPCodeRanges
+	for _, strBlock := range strBlocks {
+		for _, entry := range strings.Split(strBlock, ",") {
+			entry = strings.TrimSpace(entry)
+			negated := strings.HasPrefix(entry, "!")
+
+			block, err := parseHTTPCodeRange(strings.TrimSpace(strings.TrimPrefix(entry, "!")))
+			if err != nil {
+				return nil, fmt.Errorf("invalid status code range '%s': %w", entry, err)
+			}
+
+			if negated {
+				excluded = append(excluded, block)
+			} else {
+				blocks = append(blocks, block)
+			}
 		}
-		lowCode, err := strconv.Atoi(codes[0])
-		if err != nil {
-			return nil, err
+	}
+
+	if len(excluded) != 0 && len(blocks) == 0 {
+		return nil, fmt.Errorf("negated status code ranges need a range to exclude codes from")
+	}
+	return blocks.Subtract(excluded), nil
+}
+
+// parseHTTPCodeRange parses a single code, a range of codes or a class of codes.
+func parseHTTPCodeRange(entry string) ([2]int, error) {
+	if len(entry) == 3 && strings.HasSuffix(strings.ToLower(entry), "xx") {
+		class := int(entry[0] - '0')
+		if class < 1 || class > 5 {
+			return [2]int{}, fmt.Errorf("unknown status class")
+		}
+		return [2]int{class * 100, class*100 + 99}, nil
+	}
+
+	low, high, isRange := strings.Cut(entry, "-")
+	if !isRange {
+		// if only a single HTTP code was configured, assume the best and create the correct configuration on the user's behalf
+		high = low
+	}
+
+	lowCode, err := parseHTTPCode(low)
+	if err != nil {
+		return [2]int{}, err
+	}
+	highCode, err := parseHTTPCode(high)
+	if err != nil {
+		return [2]int{}, err
+	}
+	if lowCode > highCode {
+		return [2]int{}, fmt.Errorf("low code %d exceeds high code %d", lowCode, highCode)
+	}
+	return [2]int{lowCode, highCode}, nil
+}
+
+// parseHTTPCode parses a status code between 100 and 599.
+func parseHTTPCode(s string) (int, error) {
+	s = strings.TrimSpace(s)
+	if len(s) == 0 || strings.TrimLeft(s, "0123456789") != "" {
+		return 0, fmt.Errorf("'%s' is not a status code", s)
+	}
+	code, err := strconv.Atoi(s)
+	if err != nil || code < 100 || code > 599 {
+		return 0, fmt.Errorf("status code %s is not between 100 and 599", s)
+	}
+	return code, nil
+}
+
+// Normalize returns the ranges sorted, with overlapping and adjacent ranges merged.
+func (h HTTPCodeRanges) Normalize() HTTPCodeRanges {
+	if len(h) == 0 {
+		return nil
+	}
+
+	sorted := append(HTTPCodeRanges(nil), h...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i][0] < sorted[j][0] })
+
+	normalized := HTTPCodeRanges{sorted[0]}
+	for _, block := range sorted[1:] {
+		last := &normalized[len(normalized)-1]
+		if block[0] <= last[1]+1 {
+			if block[1] > last[1] {
+				last[1] = block[1]
+			}
+			continue
 		}
-		highCode, err := strconv.Atoi(codes[1])
-		if err != nil {
-			return nil, err
+		normalized = append(normalized, block)
+	}
+	return normalized
+}
+
+// Union returns the normalized ranges holding the codes of both h and other.
+func (h HTTPCodeRanges) Union(other HTTPCodeRanges) HTTPCodeRanges {
+	return append(append(HTTPCodeRanges(nil), h...), other...).Normalize()
+}
+
+// Subtract returns the normalized ranges holding the codes of h that are not in other.
+func (h HTTPCodeRanges) Subtract(other HTTPCodeRanges) HTTPCodeRanges {
+	result := h.Normalize()
+	for _, block := range other {
+		var remaining HTTPCodeRanges
+		for _, r := range result {
+			if block[1] < r[0] || block[0] > r[1] {
+				remaining = append(remaining, r)
+				continue
+			}
+			if r[0] < block[0] {
+				remaining = append(remaining, [2]int{r[0], block[0] - 1})
+			}
+			if r[1] > block[1] {
+				remaining = append(remaining, [2]int{block[1] + 1, r[1]})
+			}
 		}
-		blocks = append(blocks, [2]int{lowCode, highCode})
+		result = remaining
 	}
-	return blocks, nil
+	return result
+}
+
+// Complement returns the normalized ranges holding the status codes, from 100 to 599, that are not in h.
+func (h HTTPCodeRanges) Complement() HTTPCodeRanges {
+	return HTTPCodeRanges{{100, 599}}.Subtract(h)
 }
 
 // Contains tests whether the passed status code is within one of its HTTP code ranges.
@@ -43,3 +153,37 @@ func (h HTTPCodeRanges) Contains(statusCode int) bool {
 	}
 	return false
 }
+
+// String returns the normalized ranges in configuration syntax, e.g. "401-403,500-599".
+func (h HTTPCodeRanges) String() string {
+	var parts []string
+	for _, block := range h.Normalize() {
+		if block[0] == block[1] {
+			parts = append(parts, strconv.Itoa(block[0]))
+			continue
+		}
+		parts = append(parts, strconv.Itoa(block[0])+"-"+strconv.Itoa(block[1]))
+	}
+	return strings.Join(parts, ",")
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (h HTTPCodeRanges) MarshalText() ([]byte, error) {
+	return []byte(h.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler, accepting the syntax of NewHTTPCodeRanges.
+// Empty text, as marshalled from empty ranges, gives empty ranges.
+func (h *HTTPCodeRanges) UnmarshalText(text []byte) error {
+	if len(strings.TrimSpace(string(text))) == 0 {
+		*h = nil
+		return nil
+	}
+
+	ranges, err := NewHTTPCodeRanges([]string{string(text)})
+	if err != nil {
+		return err
+	}
+	*h = ranges
+	return nil
+}
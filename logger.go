@@ -0,0 +1,138 @@
+package redirecterrors
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// logLevel the verbosity of the logger, from logOff (nothing) to logDebug (everything).
+type logLevel int
+
+const (
+	logOff logLevel = iota
+	logError
+	logInfo
+	logDebug
+)
+
+var logLevelNames = map[string]logLevel{
+	"off":   logOff,
+	"error": logError,
+	"info":  logInfo,
+	"debug": logDebug,
+}
+
+// logger writes leveled, structured log lines tagged with the middleware name.
+type logger struct {
+	name  string
+	level logLevel
+	json  bool
+	out   io.Writer
+}
+
+// newLogger creates a logger writing to stdout with the given level and format (logfmt or json).
+func newLogger(name, level, format string) (*logger, error) {
+	lvl, ok := logLevelNames[strings.ToLower(level)]
+	if !ok {
+		return nil, fmt.Errorf("invalid log level '%s'", level)
+	}
+
+	var useJSON bool
+	switch strings.ToLower(format) {
+	case "", "logfmt":
+	case "json":
+		useJSON = true
+	default:
+		return nil, fmt.Errorf("invalid log format '%s'", format)
+	}
+
+	return &logger{
+		name:  name,
+		level: lvl,
+		json:  useJSON,
+		out:   os.Stdout,
+	}, nil
+}
+
+func (l *logger) error(msg string, keyValues ...string) {
+	l.log(logError, "error", msg, keyValues)
+}
+
+func (l *logger) info(msg string, keyValues ...string) {
+	l.log(logInfo, "info", msg, keyValues)
+}
+
+func (l *logger) debug(msg string, keyValues ...string) {
+	l.log(logDebug, "debug", msg, keyValues)
+}
+
+// log writes a line with the standard fields followed by the key/value pairs.
+// Pairs with an empty value are skipped.
+func (l *logger) log(level logLevel, levelName, msg string, keyValues []string) {
+	if level > l.level {
+		return
+	}
+
+	fields := []string{
+		"time", time.Now().UTC().Format(time.RFC3339),
+		"level", levelName,
+		"middleware", l.name,
+		"msg", msg,
+	}
+	for i := 0; i+1 < len(keyValues); i += 2 {
+		if len(keyValues[i+1]) != 0 {
+			fields = append(fields, keyValues[i], keyValues[i+1])
+		}
+	}
+
+	var line string
+	if l.json {
+		line = formatJSON(fields)
+	} else {
+		line = formatLogfmt(fields)
+	}
+	_, _ = io.WriteString(l.out, line+"\n")
+}
+
+func formatLogfmt(fields []string) string {
+	var sb strings.Builder
+	for i := 0; i < len(fields); i += 2 {
+		if i > 0 {
+			sb.WriteByte(' ')
+		}
+		sb.WriteString(fields[i])
+		sb.WriteByte('=')
+		value := fields[i+1]
+		if strings.ContainsAny(value, " =\"\t\r\n") {
+			value = fmt.Sprintf("%q", value)
+		}
+		sb.WriteString(value)
+	}
+	return sb.String()
+}
+
+func formatJSON(fields []string) string {
+	var sb strings.Builder
+	sb.WriteByte('{')
+	for i := 0; i < len(fields); i += 2 {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		key, _ := json.Marshal(fields[i])
+		value, _ := json.Marshal(fields[i+1])
+		sb.Write(key)
+		sb.WriteByte(':')
+		sb.Write(value)
+	}
+	sb.WriteByte('}')
+	return sb.String()
+}
+
+// redactCookie returns a Set-Cookie value with its value and attributes removed, keeping only the name.
+func redactCookie(cookie string) string {
+	return extractCookieName(cookie) + "=[REDACTED]"
+}
@@ -0,0 +1,139 @@
+package redirecterrors
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLoggerLevels(t *testing.T) {
+	testCases := []struct {
+		level    string
+		expected []string
+	}{
+		{"off", nil},
+		{"error", []string{"error"}},
+		{"info", []string{"error", "info"}},
+		{"debug", []string{"error", "info", "debug"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.level, func(t *testing.T) {
+			l, err := newLogger("my-middleware", tc.level, "logfmt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var out bytes.Buffer
+			l.out = &out
+
+			l.error("error")
+			l.info("info")
+			l.debug("debug")
+
+			lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+			if len(tc.expected) == 0 {
+				if out.Len() != 0 {
+					t.Errorf("expected no output, got %q", out.String())
+				}
+				return
+			}
+			if len(lines) != len(tc.expected) {
+				t.Fatalf("expected %d lines, got %d: %q", len(tc.expected), len(lines), out.String())
+			}
+			for i, msg := range tc.expected {
+				if !strings.Contains(lines[i], "level="+msg+" middleware=my-middleware msg="+msg) {
+					t.Errorf("unexpected line %q", lines[i])
+				}
+			}
+		})
+	}
+}
+
+func TestLoggerLogfmt(t *testing.T) {
+	l, err := newLogger("my-middleware", "info", "logfmt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	l.out = &out
+
+	l.info("redirecting", "status", "401", "rule", "login", "request_id", "", "target", "http://login/?a=b c")
+
+	line := out.String()
+	if !strings.HasSuffix(line, `level=info middleware=my-middleware msg=redirecting status=401 rule=login target="http://login/?a=b c"`+"\n") {
+		t.Errorf("unexpected line %q", line)
+	}
+}
+
+func TestLoggerJSON(t *testing.T) {
+	l, err := newLogger("my-middleware", "debug", "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	l.out = &out
+
+	l.debug("adding cookie", "cookie", redactCookie("session=secret-value; Path=/; HttpOnly"))
+
+	var fields map[string]string
+	if err := json.Unmarshal(out.Bytes(), &fields); err != nil {
+		t.Fatal(err)
+	}
+	if fields["middleware"] != "my-middleware" || fields["level"] != "debug" || fields["msg"] != "adding cookie" {
+		t.Errorf("unexpected fields %v", fields)
+	}
+	if fields["cookie"] != "session=[REDACTED]" {
+		t.Errorf("cookie value should be redacted, got %q", fields["cookie"])
+	}
+}
+
+func TestLoggerInvalidConfig(t *testing.T) {
+	if _, err := newLogger("my-middleware", "verbose", "logfmt"); err == nil {
+		t.Error("expected error for invalid level, got nil")
+	}
+	if _, err := newLogger("my-middleware", "info", "xml"); err == nil {
+		t.Error("expected error for invalid format, got nil")
+	}
+}
+
+func TestLoggerHostNotAllowed(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.Status = []string{"401"}
+	cfg.Target = "http://login.example.com/?rd={url}"
+	cfg.AllowedHosts = []string{"example.com", "*.example.com"}
+	cfg.FallbackURL = "http://login.example.com/"
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(401)
+	})
+
+	handler, err := New(context.Background(), next, cfg, "my-middleware")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	handler.(*RedirectErrors).logger.out = &out
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/app?token=secret", nil)
+	req.Header.Set("X-Forwarded-Host", "evil.com")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	// Spoofed hosts are client input: not an error, and logged without the rest of the URL
+	if out.Len() != 0 {
+		t.Errorf("expected no output at the default level, got %q", out.String())
+	}
+	handler.(*RedirectErrors).logger.level = logInfo
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	line := strings.Split(out.String(), "\n")[0]
+	if !strings.Contains(line, "level=info middleware=my-middleware msg=\"host not allowed, using the fallback url\"") || !strings.HasSuffix(line, "host=evil.com") {
+		t.Errorf("unexpected line %q", line)
+	}
+	if strings.Contains(out.String(), "secret") {
+		t.Errorf("log should not contain the query string, got %q", out.String())
+	}
+}
@@ -0,0 +1,174 @@
+package redirecterrors
+
+import (
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Outcomes of a request handled by the middleware, used as metric label values.
+const (
+	outcomeRedirected    = "redirected"
+	outcomeProblem       = "problem"
+	outcomePassedThrough = "passed_through"
+	outcomeBypassed      = "bypassed"
+)
+
+// upstreamDurationBuckets the upper bounds, in seconds, of the upstream latency histogram buckets.
+var upstreamDurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// requestKey identifies a request counter.
+type requestKey struct {
+	middleware string
+	status     string
+	rule       string
+	outcome    string
+}
+
+// histogram a Prometheus histogram with cumulative buckets.
+type histogram struct {
+	buckets []uint64
+	sum     float64
+	count   uint64
+}
+
+// metricsRegistry holds the counters and histograms of every middleware instance.
+// It is shared between instances so that a single metrics path exposes all of them,
+// and so that counts survive configuration reloads.
+type metricsRegistry struct {
+	mu        sync.Mutex
+	requests  map[requestKey]uint64
+	durations map[string]*histogram
+}
+
+// metrics the registry shared by all middleware instances.
+var metrics = newMetricsRegistry()
+
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{
+		requests:  make(map[requestKey]uint64),
+		durations: make(map[string]*histogram),
+	}
+}
+
+// countRequest increments the request counter of a middleware for a caught status, rule and outcome.
+// status and rule are empty when the response was not caught.
+func (m *metricsRegistry) countRequest(middleware string, status int, rule, outcome string) {
+	key := requestKey{middleware: middleware, rule: rule, outcome: outcome}
+	if status != 0 {
+		key.status = strconv.Itoa(status)
+	}
+
+	m.mu.Lock()
+	m.requests[key]++
+	m.mu.Unlock()
+}
+
+// observeUpstream records the duration of an upstream call of a middleware.
+func (m *metricsRegistry) observeUpstream(middleware string, duration time.Duration) {
+	seconds := duration.Seconds()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	h, ok := m.durations[middleware]
+	if !ok {
+		h = &histogram{buckets: make([]uint64, len(upstreamDurationBuckets))}
+		m.durations[middleware] = h
+	}
+	for i, bound := range upstreamDurationBuckets {
+		if seconds <= bound {
+			h.buckets[i]++
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+// writeTo writes all metrics in the Prometheus text exposition format.
+func (m *metricsRegistry) writeTo(w io.Writer) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var sb strings.Builder
+
+	keys := make([]requestKey, 0, len(m.requests))
+	for key := range m.requests {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.middleware != b.middleware {
+			return a.middleware < b.middleware
+		}
+		if a.status != b.status {
+			return a.status < b.status
+		}
+		if a.rule != b.rule {
+			return a.rule < b.rule
+		}
+		return a.outcome < b.outcome
+	})
+
+	sb.WriteString("# HELP redirecterrors_requests_total Requests handled by the middleware, by caught status, rule and outcome.\n")
+	sb.WriteString("# TYPE redirecterrors_requests_total counter\n")
+	for _, key := range keys {
+		sb.WriteString("redirecterrors_requests_total{middleware=\"" + escapeLabel(key.middleware) +
+			"\",status=\"" + key.status +
+			"\",rule=\"" + escapeLabel(key.rule) +
+			"\",outcome=\"" + key.outcome + "\"} " +
+			strconv.FormatUint(m.requests[key], 10) + "\n")
+	}
+
+	middlewares := make([]string, 0, len(m.durations))
+	for middleware := range m.durations {
+		middlewares = append(middlewares, middleware)
+	}
+	sort.Strings(middlewares)
+
+	sb.WriteString("# HELP redirecterrors_upstream_duration_seconds Duration of the calls to the next handler.\n")
+	sb.WriteString("# TYPE redirecterrors_upstream_duration_seconds histogram\n")
+	for _, middleware := range middlewares {
+		h := m.durations[middleware]
+		label := "middleware=\"" + escapeLabel(middleware) + "\""
+		for i, bound := range upstreamDurationBuckets {
+			sb.WriteString("redirecterrors_upstream_duration_seconds_bucket{" + label +
+				",le=\"" + strconv.FormatFloat(bound, 'g', -1, 64) + "\"} " +
+				strconv.FormatUint(h.buckets[i], 10) + "\n")
+		}
+		sb.WriteString("redirecterrors_upstream_duration_seconds_bucket{" + label + ",le=\"+Inf\"} " +
+			strconv.FormatUint(h.count, 10) + "\n")
+		sb.WriteString("redirecterrors_upstream_duration_seconds_sum{" + label + "} " +
+			strconv.FormatFloat(h.sum, 'g', -1, 64) + "\n")
+		sb.WriteString("redirecterrors_upstream_duration_seconds_count{" + label + "} " +
+			strconv.FormatUint(h.count, 10) + "\n")
+	}
+
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+// escapeLabel escapes a Prometheus label value.
+func escapeLabel(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `"`, `\"`)
+	return strings.ReplaceAll(value, "\n", `\n`)
+}
+
+// serveMetrics answers the metrics path.
+func (a *RedirectErrors) serveMetrics(rw http.ResponseWriter) {
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	rw.WriteHeader(http.StatusOK)
+	_ = metrics.writeTo(rw)
+}
+
+// serveNext calls the next handler, recording its duration.
+func (a *RedirectErrors) serveNext(rw http.ResponseWriter, req *http.Request) {
+	start := time.Now()
+	a.next.ServeHTTP(rw, req)
+	metrics.observeUpstream(a.name, time.Since(start))
+}
@@ -0,0 +1,109 @@
+package redirecterrors
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// problemDocument an RFC 9457 problem details document.
+type problemDocument struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Location string `json:"location,omitempty"`
+}
+
+// isAPIRequest returns whether the request comes from a client that expects JSON rather than a page,
+// i.e. an XMLHttpRequest or a request whose Accept header prefers JSON over HTML.
+func isAPIRequest(req *http.Request) bool {
+	if strings.EqualFold(req.Header.Get("X-Requested-With"), "XMLHttpRequest") {
+		return true
+	}
+
+	jsonQuality, htmlQuality := acceptQualities(req.Header.Values("Accept"))
+	return jsonQuality > 0 && jsonQuality > htmlQuality
+}
+
+// acceptQualities returns the highest quality values given to JSON and HTML media types in Accept headers.
+// Wildcards are ignored, since they do not express a preference.
+func acceptQualities(accept []string) (jsonQuality, htmlQuality float64) {
+	for _, header := range accept {
+		for _, entry := range strings.Split(header, ",") {
+			mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(entry))
+			if err != nil {
+				continue
+			}
+
+			quality := 1.0
+			if q, ok := params["q"]; ok {
+				quality, err = strconv.ParseFloat(q, 64)
+				if err != nil {
+					continue
+				}
+			}
+
+			switch {
+			case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+				if quality > jsonQuality {
+					jsonQuality = quality
+				}
+			case mediaType == "text/html" || mediaType == "application/xhtml+xml":
+				if quality > htmlQuality {
+					htmlQuality = quality
+				}
+			}
+		}
+	}
+	return jsonQuality, htmlQuality
+}
+
+// Actions for WebSocket and event stream requests.
+const (
+	streamingRequestsPassThrough = "passthrough"
+	streamingRequestsJSON        = "json"
+	streamingRequestsClose       = "close"
+)
+
+// isStreamingRequest returns whether the request opens a WebSocket or an event stream.
+func isStreamingRequest(req *http.Request) bool {
+	if strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+		return true
+	}
+	for _, accept := range req.Header.Values("Accept") {
+		for _, mediaRange := range strings.Split(accept, ",") {
+			mediaType, _, err := mime.ParseMediaType(mediaRange)
+			if err == nil && mediaType == "text/event-stream" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isPreflightRequest returns whether the request is a CORS preflight.
+func isPreflightRequest(req *http.Request) bool {
+	return req.Method == http.MethodOptions && len(req.Header.Get("Access-Control-Request-Method")) != 0
+}
+
+// writeProblem writes an application/problem+json response with the caught status,
+// carrying the computed redirect location as an extension member.
+func writeProblem(rw http.ResponseWriter, code int, location string) {
+	body, err := json.Marshal(problemDocument{
+		Type:     "about:blank",
+		Title:    http.StatusText(code),
+		Status:   code,
+		Location: location,
+	})
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/problem+json")
+	rw.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	rw.WriteHeader(code)
+	_, _ = rw.Write(body)
+}
@@ -0,0 +1,171 @@
+package redirecterrors
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// originalURL the URL requested by the client, rebuilt from the proxy headers.
+type originalURL struct {
+	proto    string
+	host     string
+	prefix   string
+	uri      string
+	path     string
+	rawQuery string
+}
+
+// reconstructURL rebuilds the original URL of a request.
+// The protocol and host come from X-Forwarded-Proto and X-Forwarded-Host, then from the
+// RFC 7239 Forwarded header, then from the request itself (req.TLS and req.Host).
+// The request URI comes from X-Forwarded-Uri, set by forwardAuth, or from the request itself,
+// and is prefixed with X-Forwarded-Prefix, set by strip-prefix middlewares.
+// A non-default X-Forwarded-Port is added to the host when it has none.
+// When trustForwarded is false, all forwarded headers are ignored.
+func reconstructURL(req *http.Request, trustForwarded bool) originalURL {
+	header := req.Header
+	if !trustForwarded {
+		header = http.Header{}
+	}
+
+	u := originalURL{
+		proto:    header.Get("X-Forwarded-Proto"),
+		host:     header.Get("X-Forwarded-Host"),
+		prefix:   strings.TrimSuffix(header.Get("X-Forwarded-Prefix"), "/"),
+		uri:      requestURI(req.URL),
+		path:     req.URL.Path,
+		rawQuery: req.URL.RawQuery,
+	}
+
+	if len(u.proto) == 0 || len(u.host) == 0 {
+		forwarded := parseForwarded(header.Values("Forwarded"))
+		if len(u.proto) == 0 {
+			u.proto = forwarded["proto"]
+		}
+		if len(u.host) == 0 {
+			u.host = forwarded["host"]
+		}
+	}
+	if len(u.proto) == 0 {
+		u.proto = "http"
+		if req.TLS != nil {
+			u.proto = "https"
+		}
+	}
+	if len(u.host) == 0 {
+		u.host = req.Host
+	}
+
+	if forwardedURI := header.Get("X-Forwarded-Uri"); strings.HasPrefix(forwardedURI, "/") {
+		if parsed, err := url.ParseRequestURI(forwardedURI); err == nil {
+			u.uri = forwardedURI
+			u.path = parsed.Path
+			u.rawQuery = parsed.RawQuery
+		}
+	}
+
+	if len(u.prefix) != 0 && u.prefix[0] == '/' {
+		u.uri = u.prefix + u.uri
+		u.path = u.prefix + u.path
+	} else {
+		u.prefix = ""
+	}
+
+	if port := header.Get("X-Forwarded-Port"); len(port) != 0 && len(u.host) != 0 && !hasPort(u.host) {
+		if !(u.proto == "http" && port == "80") && !(u.proto == "https" && port == "443") {
+			u.host = joinHostPort(u.host, port)
+		}
+	}
+
+	return u
+}
+
+// isAbsolute returns whether both the protocol and the host are known.
+func (u originalURL) isAbsolute() bool {
+	return len(u.proto) != 0 && len(u.host) != 0
+}
+
+// String returns the original URL, or only its request URI when the host is unknown.
+func (u originalURL) String() string {
+	if !u.isAbsolute() {
+		return u.uri
+	}
+	return u.proto + "://" + u.host + u.uri
+}
+
+// resolve returns the URL of a path served by the middleware, as seen by the client.
+func (u originalURL) resolve(path string) string {
+	if !u.isAbsolute() {
+		return u.prefix + path
+	}
+	return u.proto + "://" + u.host + u.prefix + path
+}
+
+// requestURI returns the escaped path and query of a URL.
+// Unlike url.URL.RequestURI, it keeps an empty path empty.
+func requestURI(u *url.URL) string {
+	uri := u.EscapedPath()
+	if len(u.RawQuery) != 0 || u.ForceQuery {
+		uri += "?" + u.RawQuery
+	}
+	return uri
+}
+
+// parseForwarded returns the parameters of the first element of RFC 7239 Forwarded headers,
+// i.e. the one added by the proxy closest to the client.
+func parseForwarded(headers []string) map[string]string {
+	elements := parseForwardedElements(headers)
+	if len(elements) == 0 {
+		return make(map[string]string)
+	}
+	return elements[0]
+}
+
+// parseForwardedElements returns the parameters of every element of RFC 7239 Forwarded headers,
+// from the closest to the client to the closest to the middleware. Parameter names are lowercased.
+func parseForwardedElements(headers []string) []map[string]string {
+	var elements []map[string]string
+	for _, header := range headers {
+		for _, element := range strings.Split(header, ",") {
+			params := make(map[string]string)
+			for _, pair := range strings.Split(element, ";") {
+				key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if !ok {
+					continue
+				}
+				value = strings.TrimSpace(value)
+				if unquoted, err := strconv.Unquote(value); err == nil && strings.HasPrefix(value, "\"") {
+					value = unquoted
+				}
+				params[strings.ToLower(strings.TrimSpace(key))] = value
+			}
+			elements = append(elements, params)
+		}
+	}
+	return elements
+}
+
+// forwardedNodeIP returns the IP address of a Forwarded "for" node, or "" for obfuscated and unknown nodes.
+func forwardedNodeIP(node string) string {
+	if len(node) == 0 || node == "unknown" || strings.HasPrefix(node, "_") {
+		return ""
+	}
+	return stripPort(node)
+}
+
+// hasPort returns whether a host includes a port.
+func hasPort(host string) bool {
+	_, _, err := net.SplitHostPort(host)
+	return err == nil
+}
+
+// joinHostPort adds a port to a host, keeping IPv6 brackets.
+func joinHostPort(host, port string) string {
+	if strings.Contains(host, ":") && !strings.HasPrefix(host, "[") {
+		host = "[" + host + "]"
+	}
+	return host + ":" + port
+}
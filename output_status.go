@@ -0,0 +1,68 @@
+package redirecterrors
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// outputStatusAuto the output status picking the status of the redirect from the request method.
+const outputStatusAuto = "auto"
+
+// Actions for unsafe methods, other than form submissions, in the auto output status mode.
+const (
+	unsafeMethodsRedirect    = "redirect"
+	unsafeMethodsPassThrough = "passthrough"
+)
+
+// parseOutputStatus parses an output status, either an HTTP code or outputStatusAuto.
+func parseOutputStatus(value string) (status int, auto bool, err error) {
+	value = strings.TrimSpace(value)
+	if strings.EqualFold(value, outputStatusAuto) {
+		return 0, true, nil
+	}
+	status, err = strconv.Atoi(value)
+	if err != nil || status < 100 || status > 599 {
+		return 0, false, fmt.Errorf("invalid output status '%s'", value)
+	}
+	return status, false, nil
+}
+
+// autoOutputStatus returns the redirect status suited to the request method:
+// 302 for GET and HEAD, 303 for POST form submissions, so the browser follows with a GET,
+// and 307 for other methods, so the method and body are kept.
+func autoOutputStatus(req *http.Request) int {
+	switch {
+	case req.Method == http.MethodGet || req.Method == http.MethodHead:
+		return http.StatusFound
+	case req.Method == http.MethodPost && isFormSubmission(req):
+		return http.StatusSeeOther
+	default:
+		return http.StatusTemporaryRedirect
+	}
+}
+
+// isFormSubmission returns whether the request body is an HTML form.
+func isFormSubmission(req *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	return err == nil && (mediaType == "application/x-www-form-urlencoded" || mediaType == "multipart/form-data")
+}
+
+// newMethodSet returns the set of methods, uppercased. It returns nil when methods is empty, matching every method.
+func newMethodSet(methods []string) (map[string]bool, error) {
+	if len(methods) == 0 {
+		return nil, nil
+	}
+
+	set := make(map[string]bool)
+	for _, method := range methods {
+		method = strings.ToUpper(strings.TrimSpace(method))
+		if len(method) == 0 || strings.ContainsAny(method, " \t/,;") {
+			return nil, fmt.Errorf("invalid method '%s'", method)
+		}
+		set[method] = true
+	}
+	return set, nil
+}
@@ -0,0 +1,93 @@
+package redirecterrors
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// regexPathPrefix marks a path pattern as a regular expression instead of a glob.
+const regexPathPrefix = "regex:"
+
+// pathMatcher decides whether a request path is subject to redirection.
+// A path matches when it matches any include pattern (or there are none)
+// and none of the exclude patterns.
+type pathMatcher struct {
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+}
+
+// newPathMatcher compiles include and exclude path patterns.
+// Patterns prefixed with "regex:" are regular expressions, others are globs
+// where '*' matches any sequence of characters (including '/') and '?' matches a single character.
+func newPathMatcher(include, exclude []string) (*pathMatcher, error) {
+	includePatterns, err := compilePathPatterns(include)
+	if err != nil {
+		return nil, err
+	}
+
+	excludePatterns, err := compilePathPatterns(exclude)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pathMatcher{
+		include: includePatterns,
+		exclude: excludePatterns,
+	}, nil
+}
+
+func compilePathPatterns(patterns []string) ([]*regexp.Regexp, error) {
+	var compiled []*regexp.Regexp
+	for _, pattern := range patterns {
+		expr := globToRegexp(pattern)
+		if strings.HasPrefix(pattern, regexPathPrefix) {
+			expr = strings.TrimPrefix(pattern, regexPathPrefix)
+		}
+
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid path pattern '%s': %w", pattern, err)
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled, nil
+}
+
+// globToRegexp converts a glob pattern to an anchored regular expression.
+func globToRegexp(glob string) string {
+	var sb strings.Builder
+	sb.WriteString("^")
+	for _, r := range glob {
+		switch r {
+		case '*':
+			sb.WriteString(".*")
+		case '?':
+			sb.WriteString(".")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	sb.WriteString("$")
+	return sb.String()
+}
+
+// matches returns whether the path is subject to redirection.
+func (pm *pathMatcher) matches(path string) bool {
+	for _, re := range pm.exclude {
+		if re.MatchString(path) {
+			return false
+		}
+	}
+
+	if len(pm.include) == 0 {
+		return true
+	}
+
+	for _, re := range pm.include {
+		if re.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
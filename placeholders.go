@@ -0,0 +1,46 @@
+package redirecterrors
+
+import (
+	"net/http"
+)
+
+// placeholders resolves the placeholders of targets and body templates for a request.
+type placeholders struct {
+	values map[string]string
+	req    *http.Request
+}
+
+// lookup returns the value of a placeholder, given its name and optional argument.
+func (p placeholders) lookup(name, arg string) (string, bool) {
+	switch name {
+	case "header":
+		return p.req.Header.Get(arg), true
+	case "cookie":
+		cookie, err := p.req.Cookie(arg)
+		if err != nil {
+			return "", true
+		}
+		return cookie.Value, true
+	case "query":
+		if len(arg) != 0 {
+			return p.req.URL.Query().Get(arg), true
+		}
+	}
+
+	if len(arg) != 0 {
+		return "", false
+	}
+	value, ok := p.values[name]
+	return value, ok
+}
+
+// requestValues returns the placeholders derived from the request itself.
+func requestValues(req *http.Request, remoteIP string) map[string]string {
+	return map[string]string{
+		"path":       req.URL.Path,
+		"query":      req.URL.RawQuery,
+		"method":     req.Method,
+		"remote_ip":  remoteIP,
+		"request_id": req.Header.Get("X-Request-Id"),
+	}
+}
@@ -10,25 +10,75 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // Config the plugin configuration.
 type Config struct {
-	Status              []string          `json:"status,omitempty"`
-	Target              string            `json:"target,omitempty"`
-	OutputStatus        int               `json:"outputStatus,omitempty"`
-	OutputAddHeaders    map[string]string `json:"outputAddHeaders,omitempty"`
-	OutputRemoveHeaders []string         `json:"outputRemoveHeaders,omitempty"`
-	OutputAddCookies    []string         `json:"outputAddCookies,omitempty"`
-	OutputRemoveCookies []string         `json:"outputRemoveCookies,omitempty"`
+	Status                     []string          `json:"status,omitempty"`
+	HeaderTriggers             []HeaderTrigger   `json:"headerTriggers,omitempty"`
+	BodyMatch                  *BodyMatch        `json:"bodyMatch,omitempty"`
+	BodyBufferSize             int               `json:"bodyBufferSize,omitempty"`
+	Target                     string            `json:"target,omitempty"`
+	TargetHeader               string            `json:"targetHeader,omitempty"`
+	OutputStatus               string            `json:"outputStatus,omitempty"`
+	AutoUnsafeMethods          string            `json:"autoUnsafeMethods,omitempty"`
+	Methods                    []string          `json:"methods,omitempty"`
+	Rules                      []Rule            `json:"rules,omitempty"`
+	IncludePaths               []string          `json:"includePaths,omitempty"`
+	ExcludePaths               []string          `json:"excludePaths,omitempty"`
+	BypassPreflight            bool              `json:"bypassPreflight,omitempty"`
+	StreamingRequests          string            `json:"streamingRequests,omitempty"`
+	OutputMode                 string            `json:"outputMode,omitempty"`
+	ProblemDetails             bool              `json:"problemDetails,omitempty"`
+	AllowedHosts               []string          `json:"allowedHosts,omitempty"`
+	FallbackURL                string            `json:"fallbackUrl,omitempty"`
+	TrustedProxies             []string          `json:"trustedProxies,omitempty"`
+	SigningSecret              string            `json:"signingSecret,omitempty"`
+	SigningSecretFile          string            `json:"signingSecretFile,omitempty"`
+	SignatureTTL               string            `json:"signatureTtl,omitempty"`
+	ReturnCookieSecret         string            `json:"returnCookieSecret,omitempty"`
+	ReturnCookieSecretFile     string            `json:"returnCookieSecretFile,omitempty"`
+	ReturnCookieName           string            `json:"returnCookieName,omitempty"`
+	ReturnCookieDomain         string            `json:"returnCookieDomain,omitempty"`
+	ReturnCookieTTL            string            `json:"returnCookieTtl,omitempty"`
+	ReturnPath                 string            `json:"returnPath,omitempty"`
+	ReplayPost                 bool              `json:"replayPost,omitempty"`
+	ReplayPostMaxSize          int               `json:"replayPostMaxSize,omitempty"`
+	OutputBody                 string            `json:"outputBody,omitempty"`
+	OutputBodyFile             string            `json:"outputBodyFile,omitempty"`
+	OutputContentType          string            `json:"outputContentType,omitempty"`
+	MetricsPath                string            `json:"metricsPath,omitempty"`
+	LogLevel                   string            `json:"logLevel,omitempty"`
+	LogFormat                  string            `json:"logFormat,omitempty"`
+	OutputCopyHeaders          string            `json:"outputCopyHeaders,omitempty"`
+	OutputCopyHeadersAllowlist []string          `json:"outputCopyHeadersAllowlist,omitempty"`
+	OutputAddHeaders           map[string]string `json:"outputAddHeaders,omitempty"`
+	OutputRemoveHeaders        []string          `json:"outputRemoveHeaders,omitempty"`
+	OutputAddCookies           []string          `json:"outputAddCookies,omitempty"`
+	OutputRemoveCookies        []string          `json:"outputRemoveCookies,omitempty"`
 }
 
 // CreateConfig creates the default plugin configuration.
 func CreateConfig() *Config {
 	return &Config{
-		Status:       []string{},
-		Target:       "",
-		OutputStatus: 302,
+		Status:            []string{},
+		Target:            "",
+		OutputStatus:      "302",
+		AutoUnsafeMethods: unsafeMethodsRedirect,
+		BypassPreflight:   true,
+		StreamingRequests: streamingRequestsPassThrough,
+		BodyBufferSize:    defaultBodyBufferSize,
+		OutputMode:        outputModeRedirect,
+		OutputContentType: "text/plain; charset=utf-8",
+		SignatureTTL:      "10m",
+		ReturnCookieName:  "redirecterrors_return",
+		ReturnCookieTTL:   "10m",
+		ReturnPath:        "/_redirecterrors/return",
+		ReplayPostMaxSize: maxReplayPostSize,
+		LogLevel:          "error",
+		LogFormat:         "logfmt",
+		OutputCopyHeaders: copyHeadersAll,
 	}
 }
 
@@ -36,9 +86,25 @@ func CreateConfig() *Config {
 type RedirectErrors struct {
 	name                string
 	next                http.Handler
-	httpCodeRanges      HTTPCodeRanges
-	target              string
-	outputStatus        int
+	rules               []*redirectRule
+	paths               *pathMatcher
+	bypassPreflight     bool
+	streamingRequests   string
+	autoUnsafeMethods   string
+	bodyBufferSize      int
+	outputMode          string
+	outputBody          *bodyTemplate
+	problemDetails      bool
+	allowedHosts        *hostAllowlist
+	fallbackURL         string
+	trustedProxies      *trustedProxies
+	signer              *urlSigner
+	returnCookie        *returnCookie
+	replayPost          bool
+	replayPostMaxSize   int
+	logger              *logger
+	metricsPath         string
+	outputCopyHeaders   *headerCopyPolicy
 	outputAddHeaders    map[string]string
 	outputRemoveHeaders []*regexp.Regexp
 	outputAddCookies    []string
@@ -47,11 +113,100 @@ type RedirectErrors struct {
 
 // New creates a new RedirectErrors plugin.
 func New(ctx context.Context, next http.Handler, config *Config, name string) (http.Handler, error) {
-	if len(config.Target) == 0 {
-		return nil, fmt.Errorf("target url must be set")
+	if config.OutputMode != outputModeRedirect && config.OutputMode != outputModeHTML {
+		return nil, fmt.Errorf("invalid output mode '%s'", config.OutputMode)
 	}
 
-	httpCodeRanges, err := NewHTTPCodeRanges(config.Status)
+	switch config.StreamingRequests {
+	case streamingRequestsPassThrough, streamingRequestsJSON, streamingRequestsClose:
+	default:
+		return nil, fmt.Errorf("invalid streaming requests action '%s'", config.StreamingRequests)
+	}
+
+	if config.AutoUnsafeMethods != unsafeMethodsRedirect && config.AutoUnsafeMethods != unsafeMethodsPassThrough {
+		return nil, fmt.Errorf("invalid auto unsafe methods action '%s'", config.AutoUnsafeMethods)
+	}
+
+	outputBody, err := newBodyTemplate(config.OutputBody, config.OutputBodyFile, config.OutputContentType)
+	if err != nil {
+		return nil, err
+	}
+
+	logger, err := newLogger(name, config.LogLevel, config.LogFormat)
+	if err != nil {
+		return nil, err
+	}
+
+	rules, err := newRedirectRules(config)
+	if err != nil {
+		return nil, err
+	}
+	if len(rulesWithBodyMatch(rules)) != 0 && config.BodyBufferSize <= 0 {
+		return nil, fmt.Errorf("bodyBufferSize must be positive to match bodies")
+	}
+	for _, rule := range rules {
+		logger.debug("rule loaded", "rule", rule.name, "status", rule.httpCodeRanges.String())
+	}
+
+	paths, err := newPathMatcher(config.IncludePaths, config.ExcludePaths)
+	if err != nil {
+		return nil, err
+	}
+
+	allowedHosts, err := newHostAllowlist(config.AllowedHosts)
+	if err != nil {
+		return nil, err
+	}
+
+	// Upstream targets are only trusted for the hosts listed explicitly
+	for _, rule := range rules {
+		if len(rule.targetHeader) != 0 && allowedHosts.isEmpty() {
+			return nil, fmt.Errorf("targetHeader needs allowedHosts")
+		}
+	}
+
+	trustedProxies, err := newTrustedProxies(config.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := newURLSigner(config.SigningSecret, config.SigningSecretFile, config.SignatureTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	returnCookie, err := newReturnCookie(config)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.ReplayPost {
+		if returnCookie == nil {
+			return nil, fmt.Errorf("replayPost needs a return cookie secret")
+		}
+		if config.ReplayPostMaxSize <= 0 || config.ReplayPostMaxSize > maxReplayPostSize {
+			return nil, fmt.Errorf("replayPostMaxSize must be between 1 and %d", maxReplayPostSize)
+		}
+	}
+
+	// Some placeholders only have a value when their feature is configured
+	var templates []*template
+	for _, rule := range rules {
+		templates = append(templates, rule.target)
+	}
+	if outputBody != nil {
+		templates = append(templates, outputBody.template)
+	}
+	for _, t := range templates {
+		if signer == nil && t.uses(signaturePlaceholders...) {
+			return nil, fmt.Errorf("signature placeholders need a signing secret")
+		}
+		if returnCookie == nil && t.uses("return_url") {
+			return nil, fmt.Errorf("placeholder '{return_url}' needs a return cookie secret")
+		}
+	}
+
+	outputCopyHeaders, err := newHeaderCopyPolicy(config.OutputCopyHeaders, config.OutputCopyHeadersAllowlist)
 	if err != nil {
 		return nil, err
 	}
@@ -77,11 +232,27 @@ func New(ctx context.Context, next http.Handler, config *Config, name string) (h
 	}
 
 	return &RedirectErrors{
-		httpCodeRanges:      httpCodeRanges,
 		next:                next,
 		name:                name,
-		target:              config.Target,
-		outputStatus:        config.OutputStatus,
+		rules:               rules,
+		paths:               paths,
+		bypassPreflight:     config.BypassPreflight,
+		streamingRequests:   config.StreamingRequests,
+		autoUnsafeMethods:   config.AutoUnsafeMethods,
+		bodyBufferSize:      config.BodyBufferSize,
+		outputMode:          config.OutputMode,
+		outputBody:          outputBody,
+		problemDetails:      config.ProblemDetails,
+		allowedHosts:        allowedHosts,
+		fallbackURL:         config.FallbackURL,
+		trustedProxies:      trustedProxies,
+		signer:              signer,
+		returnCookie:        returnCookie,
+		replayPost:          config.ReplayPost,
+		replayPostMaxSize:   config.ReplayPostMaxSize,
+		logger:              logger,
+		metricsPath:         config.MetricsPath,
+		outputCopyHeaders:   outputCopyHeaders,
 		outputAddHeaders:    config.OutputAddHeaders,
 		outputRemoveHeaders: removePatterns,
 		outputAddCookies:    config.OutputAddCookies,
@@ -90,48 +261,152 @@ func New(ctx context.Context, next http.Handler, config *Config, name string) (h
 }
 
 func (a *RedirectErrors) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
-	catcher := newCodeCatcher(rw, a.httpCodeRanges)
+	if a.returnCookie != nil && req.URL.Path == a.returnCookie.path {
+		a.serveReturn(rw, req)
+		return
+	}
 
-	a.next.ServeHTTP(catcher, req)
-	if !catcher.isFilteredCode() {
+	if len(a.metricsPath) != 0 && req.URL.Path == a.metricsPath {
+		a.serveMetrics(rw)
 		return
 	}
-	code := catcher.getCode()
-	println("Caught HTTP status code", code, "redirecting")
+
+	// Browsers fail CORS preflights answered with a redirect
+	var rules []*redirectRule
+	if a.paths.matches(req.URL.Path) && !(a.bypassPreflight && isPreflightRequest(req)) {
+		rules = applicableRules(a.rules, req)
+	}
+
+	// WebSocket and event stream clients cannot follow a redirect
+	streaming := isStreamingRequest(req)
+	if streaming && a.streamingRequests == streamingRequestsPassThrough {
+		rules = nil
+	}
+	if len(rules) == 0 {
+		metrics.countRequest(a.name, 0, "", outcomeBypassed)
+		a.serveNext(rw, req)
+		return
+	}
+
+	catcher := newCodeCatcher(rw, rulesHTTPCodeRanges(rules), rulesHeaderTriggers(rules))
+	if bodyRules := rulesWithBodyMatch(rules); len(bodyRules) != 0 {
+		catcher.bufferBodies(rulesHTTPCodeRanges(bodyRules), rulesHeaderTriggers(bodyRules), a.bodyBufferSize)
+	}
 
 	// try to cobble together the original URL
-	proto := req.Header.Get("X-Forwarded-Proto")
-	host := req.Header.Get("X-Forwarded-Host")
-	fullURL := req.URL.String()
-	if len(proto) != 0 && len(host) != 0 {
-		fullURL = proto + "://" + host
-		fullURL += req.URL.RequestURI()
-	} else {
-		println("Missing proxy headers!")
+	original := reconstructURL(req, a.trustedProxies.trusts(req))
+
+	// The upstream consumes the body, keep a copy of forms to replay them after re-authentication
+	var replayBody []byte
+	if a.replayPost && isSameOriginRequest(req, original.host) {
+		replayBody = stashFormBody(req, a.replayPostMaxSize)
+	}
+
+	a.serveNext(catcher, req)
+	// An upstream writing nothing never calls WriteHeader, check its headers for triggers and send them now
+	catcher.WriteHeader(catcher.getCode())
+	code := catcher.getCode()
+	if !catcher.isFilteredCode() {
+		if catcher.isBufferOverflowed() {
+			a.logger.debug("response body over the buffer size, passing it through", "status", strconv.Itoa(code), "request_id", req.Header.Get("X-Request-Id"))
+		}
+		metrics.countRequest(a.name, code, "", outcomePassedThrough)
+		return
+	}
+	rule := matchRule(rules, code, catcher.getHeaders(), catcher.getBody())
+	if rule == nil {
+		metrics.countRequest(a.name, code, "", outcomePassedThrough)
+		catcher.passThrough()
+		return
+	}
+	logFields := []string{
+		"status", strconv.Itoa(code),
+		"rule", rule.name,
+		"request_id", req.Header.Get("X-Request-Id"),
+	}
+	a.logger.debug("caught status code", logFields...)
+
+	if streaming && a.streamingRequests == streamingRequestsClose {
+		a.logger.info("streaming request, closing the connection", logFields...)
+		metrics.countRequest(a.name, code, rule.name, outcomePassedThrough)
+		rw.Header().Set("Connection", "close")
+		rw.Header().Set("Content-Length", "0")
+		rw.WriteHeader(code)
+		return
+	}
+
+	// Redirecting an unsafe request, such as an API call, may be worse than failing it
+	outputStatus := rule.outputStatusFor(req)
+	if rule.autoStatus && outputStatus == http.StatusTemporaryRedirect && a.autoUnsafeMethods == unsafeMethodsPassThrough {
+		a.logger.debug("unsafe method, passing the original error through", append(logFields, "method", req.Method)...)
+		metrics.countRequest(a.name, code, rule.name, outcomePassedThrough)
+		catcher.passThrough()
+		return
 	}
 
-	location := a.target
-	if len(proto) != 0 {
-    	location = strings.ReplaceAll(location, "{proto}", proto)
+	fullURL := original.String()
+	if !original.isAbsolute() {
+		a.logger.debug("unknown original host", logFields...)
 	}
-	if len(host) != 0 {
-        location = strings.ReplaceAll(location, "{host}", host)
-    }
-    location = strings.ReplaceAll(location, "{status}", strconv.Itoa(code))
-    location = strings.ReplaceAll(location, "{url}", fullURL)
-	location = strings.ReplaceAll(location, "{uri}", url.QueryEscape(fullURL))
 
-	println("New location:", location)
+	values := a.placeholders(req, code, original, fullURL)
+	location := rule.target.render(values, nil)
 
-	// First, copy all headers from the catcher to the response writer
-	for key, values := range catcher.getHeaders() {
-		for _, value := range values {
-			rw.Header().Add(key, value)
+	// Prefer the login URL chosen by the upstream, as long as it points to an allowed host
+	fromTarget := true
+	if len(rule.targetHeader) != 0 {
+		upstreamLocation := catcher.getHeaders().Get(rule.targetHeader)
+		switch {
+		case len(upstreamLocation) == 0:
+			a.logger.debug("no upstream target, using the target", append(logFields, "header", rule.targetHeader)...)
+		case !a.allowedHosts.allowsURL(upstreamLocation):
+			a.logger.info("upstream target not allowed, using the target", append(logFields, "header", rule.targetHeader, "upstream_target", upstreamLocation)...)
+		default:
+			location = upstreamLocation
+			fromTarget = false
 		}
 	}
 
-	// Set the Location header
-	rw.Header().Set("Location", location)
+	fallback := false
+	// Never hand out a return URL or a redirect to a host outside the allowlist,
+	// since forwarded headers can be spoofed by any client
+	// Rejections come from client input, so they are logged at info level and without the rest of the URL
+	rejected := fullURL
+	if a.allowedHosts.allowsURL(fullURL) {
+		rejected = location
+	}
+	if !a.allowedHosts.allowsURL(rejected) {
+		if len(a.fallbackURL) == 0 {
+			a.logger.info("host not allowed, passing the original error through", append(logFields, "host", urlHost(rejected))...)
+			metrics.countRequest(a.name, code, rule.name, outcomePassedThrough)
+			catcher.passThrough()
+			return
+		}
+		a.logger.info("host not allowed, using the fallback url", append(logFields, "host", urlHost(rejected))...)
+		location = a.fallbackURL
+		fromTarget = false
+		fallback = true
+	}
+
+	a.logger.info("redirecting", append(logFields, "target", location)...)
+
+	// Responses to HEAD requests carry the headers of the redirect but no body
+	if req.Method == http.MethodHead {
+		rw = headResponseWriter{rw}
+	}
+
+	// API and streaming clients cannot follow a redirect to a login page, answer them with a problem document instead
+	problem := a.problemDetails && isAPIRequest(req) || streaming && a.streamingRequests == streamingRequestsJSON
+
+	// First, copy the upstream headers allowed by the copy policy to the response writer
+	a.outputCopyHeaders.copy(rw.Header(), catcher.getHeaders())
+
+	// Set the Location header, dropping the upstream one from responses that are not redirects
+	if !problem && a.outputMode == outputModeRedirect {
+		rw.Header().Set("Location", location)
+	} else {
+		rw.Header().Del("Location")
+	}
 
 	// Add custom headers
 	for key, value := range a.outputAddHeaders {
@@ -143,7 +418,7 @@ func (a *RedirectErrors) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		for _, re := range a.outputRemoveHeaders {
 			if re.MatchString(key) {
 				rw.Header().Del(key)
-				println("Removing header:", key)
+				a.logger.debug("removing header", append(logFields, "header", key)...)
 				break
 			}
 		}
@@ -152,7 +427,22 @@ func (a *RedirectErrors) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	// Add cookies from outputAddCookies
 	for _, cookie := range a.outputAddCookies {
 		rw.Header().Add("Set-Cookie", cookie)
-		println("Adding cookie:", extractCookieName(cookie))
+		a.logger.debug("adding cookie", append(logFields, "cookie", redactCookie(cookie))...)
+	}
+
+	// Store the original URL in the encrypted return cookie, unless it was rejected for the fallback
+	if a.returnCookie != nil && !fallback {
+		cookie, err := a.returnCookie.build(fullURL, string(replayBody), time.Now())
+		if err == nil && len(cookie) > maxCookieSize {
+			a.logger.debug("form too large for the return cookie, not replaying it", logFields...)
+			cookie, err = a.returnCookie.build(fullURL, "", time.Now())
+		}
+		if err != nil {
+			a.logger.error("cannot build the return cookie", append(logFields, "error", err.Error())...)
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		rw.Header().Add("Set-Cookie", cookie)
 	}
 
 	// Remove cookies matching regex patterns from outputRemoveCookies
@@ -168,7 +458,7 @@ func (a *RedirectErrors) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 						deletionCookie := cookieName + "=; Path=/; Max-Age=0; HttpOnly; Secure"
 						rw.Header().Add("Set-Cookie", deletionCookie)
 						removedCookies[cookieName] = true
-						println("Removing cookie:", cookieName)
+						a.logger.debug("removing cookie", append(logFields, "cookie", cookieName)...)
 					}
 					break
 				}
@@ -176,14 +466,85 @@ func (a *RedirectErrors) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		}
 	}
 
-	rw.WriteHeader(a.outputStatus)
-	_, err := io.WriteString(rw, "Redirecting")
+	if problem {
+		metrics.countRequest(a.name, code, rule.name, outcomeProblem)
+		writeProblem(rw, code, location)
+		return
+	}
+
+	metrics.countRequest(a.name, code, rule.name, outcomeRedirected)
+
+	if a.outputMode == outputModeHTML {
+		// Signatures cover the URL without its fragment, so only unsigned targets get it appended
+		var scriptLocation string
+		if fromTarget && !rule.target.uses(signaturePlaceholders...) {
+			scriptLocation = rule.target.render(a.placeholders(req, code, original, fullURL+fragmentMarker), nil)
+		}
+		writeHTMLRedirect(rw, location, scriptLocation)
+		return
+	}
+
+	body := defaultBody
+	if a.outputBody != nil {
+		body = a.outputBody.render(values, location)
+		rw.Header().Set("Content-Type", a.outputBody.contentType)
+	} else if len(rw.Header().Get("Content-Type")) == 0 {
+		rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	rw.Header().Set("Content-Length", strconv.Itoa(len(body)))
+
+	rw.WriteHeader(outputStatus)
+	_, err := io.WriteString(rw, body)
 	if err != nil {
 		http.Error(rw, err.Error(), http.StatusInternalServerError)
 		return
 	}
 }
 
+// placeholders returns the placeholders and their values for the current request.
+func (a *RedirectErrors) placeholders(req *http.Request, code int, original originalURL, fullURL string) placeholders {
+	values := requestValues(req, a.trustedProxies.clientIP(req))
+	values["path"] = original.path
+	values["query"] = original.rawQuery
+	if len(original.proto) != 0 {
+		values["proto"] = original.proto
+	}
+	if len(original.host) != 0 {
+		values["host"] = original.host
+	}
+	if a.signer != nil {
+		exp, sig := a.signer.sign(fullURL, time.Now())
+		values["signed_url"] = url.QueryEscape(fullURL) + "&exp=" + exp + "&sig=" + sig
+		values["exp"] = exp
+		values["sig"] = sig
+	}
+	if a.returnCookie != nil {
+		values["return_url"] = url.QueryEscape(original.resolve(a.returnCookie.path))
+	}
+	values["status"] = strconv.Itoa(code)
+	values["url"] = fullURL
+	values["uri"] = url.QueryEscape(fullURL)
+
+	return placeholders{values: values, req: req}
+}
+
+// writeText writes a plain text response with its Content-Type and Content-Length.
+func writeText(rw http.ResponseWriter, code int, body string) {
+	rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	rw.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	rw.WriteHeader(code)
+	_, _ = io.WriteString(rw, body)
+}
+
+// headResponseWriter drops the body written in answer to a HEAD request.
+type headResponseWriter struct {
+	http.ResponseWriter
+}
+
+func (w headResponseWriter) Write(buf []byte) (int, error) {
+	return len(buf), nil
+}
+
 // extractCookieName extracts the cookie name from a Set-Cookie header value.
 func extractCookieName(cookieStr string) string {
 	// Cookie format: "name=value; attributes"
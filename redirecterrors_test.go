@@ -1,11 +1,25 @@
 package redirecterrors_test
 
 import (
+	"bufio"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/iskans/redirecterrors"
 )
@@ -110,7 +124,7 @@ func TestRedirectWithCustomHeaders(t *testing.T) {
 	cfg := redirecterrors.CreateConfig()
 	cfg.Status = []string{"401"}
 	cfg.Target = "http://target/?status={status}&url={url}"
-	cfg.OutputStatus = 302
+	cfg.OutputStatus = "302"
 	cfg.OutputAddHeaders = map[string]string{
 		"Set-Cookie":      "session=; Path=/; Domain=.example.com; HttpOnly; Secure; Max-Age=0",
 		"X-Custom-Header": "custom-value",
@@ -152,7 +166,7 @@ func TestRedirectWithRemoveHeaders(t *testing.T) {
 	cfg := redirecterrors.CreateConfig()
 	cfg.Status = []string{"401"}
 	cfg.Target = "http://target/?status={status}&url={url}"
-	cfg.OutputStatus = 302
+	cfg.OutputStatus = "302"
 	cfg.OutputRemoveHeaders = []string{
 		"^Authentik-Proxy-.+$",
 		"^[^-]+-Tk-.+$",
@@ -218,7 +232,7 @@ func TestRedirectWithAddCookies(t *testing.T) {
 	cfg := redirecterrors.CreateConfig()
 	cfg.Status = []string{"401"}
 	cfg.Target = "http://target/?status={status}&url={url}"
-	cfg.OutputStatus = 302
+	cfg.OutputStatus = "302"
 	cfg.OutputAddCookies = []string{
 		"session=123; Path=/; Domain=.example.com; HttpOnly; Secure",
 		"mycookie=yes; Path=/; Domain=.example.com; HttpOnly; Secure",
@@ -276,7 +290,7 @@ func TestRedirectWithRemoveCookies(t *testing.T) {
 	cfg := redirecterrors.CreateConfig()
 	cfg.Status = []string{"401"}
 	cfg.Target = "http://target/?status={status}&url={url}"
-	cfg.OutputStatus = 302
+	cfg.OutputStatus = "302"
 	cfg.OutputRemoveCookies = []string{
 		"^authentik_proxy_.+$",
 		"^[^_]+_tk_.+$",
@@ -362,7 +376,7 @@ func TestRedirectWithBody(t *testing.T) {
 	cfg := redirecterrors.CreateConfig()
 	cfg.Status = []string{"401"}
 	cfg.Target = "http://target/?status={status}&url={url}"
-	cfg.OutputStatus = 302
+	cfg.OutputStatus = "302"
 
 	ctx := context.Background()
 	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
@@ -399,7 +413,7 @@ func TestRedirectWithoutWriteHeader(t *testing.T) {
 	cfg := redirecterrors.CreateConfig()
 	cfg.Status = []string{"200-299"}
 	cfg.Target = "http://target/?status={status}&url={url}"
-	cfg.OutputStatus = 302
+	cfg.OutputStatus = "302"
 
 	ctx := context.Background()
 	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
@@ -531,7 +545,7 @@ func TestFullURLWithForwardedHeaders(t *testing.T) {
 	cfg := redirecterrors.CreateConfig()
 	cfg.Status = []string{"401"}
 	cfg.Target = "http://target/?return={url}"
-	cfg.OutputStatus = 302
+	cfg.OutputStatus = "302"
 
 	ctx := context.Background()
 	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
@@ -793,7 +807,7 @@ func TestOutputStatusCodes(t *testing.T) {
 			cfg := redirecterrors.CreateConfig()
 			cfg.Status = []string{"401"}
 			cfg.Target = "http://target/"
-			cfg.OutputStatus = tc.outputStatus
+			cfg.OutputStatus = fmt.Sprint(tc.outputStatus)
 
 			ctx := context.Background()
 			next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
@@ -1361,7 +1375,7 @@ func TestRedirectWithMultipleStatusCodes(t *testing.T) {
 	cfg := redirecterrors.CreateConfig()
 	cfg.Status = []string{"401", "403", "500-503"}
 	cfg.Target = "http://target/?error={status}"
-	cfg.OutputStatus = 307
+	cfg.OutputStatus = "307"
 
 	ctx := context.Background()
 
@@ -1394,3 +1408,2521 @@ func TestRedirectWithMultipleStatusCodes(t *testing.T) {
 		})
 	}
 }
+
+func TestRedirectRules(t *testing.T) {
+	// Test that each rule sends its statuses to its own target
+	cfg := redirecterrors.CreateConfig()
+	cfg.Rules = []redirecterrors.Rule{
+		{Status: []string{"401"}, Target: "http://login/?url={url}"},
+		{Status: []string{"403"}, Target: "http://denied/?status={status}"},
+		{Status: []string{"500-599"}, Target: "http://status/", OutputStatus: "307"},
+	}
+
+	ctx := context.Background()
+
+	testCases := []struct {
+		code     int
+		expected int
+		location string
+	}{
+		{401, 302, "http://login/?url=http://localhost"},
+		{403, 302, "http://denied/?status=403"},
+		{503, 307, "http://status/"},
+		{404, 404, ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("status_%d", tc.code), func(t *testing.T) {
+			next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				rw.WriteHeader(tc.code)
+			})
+
+			handler, err := redirecterrors.New(ctx, next, cfg, "redirecterrors-plugin")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			recorder := httptest.NewRecorder()
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			handler.ServeHTTP(recorder, req)
+
+			resp := recorder.Result()
+			assertCode(t, resp, tc.expected)
+			assertHeader(t, resp, "Location", tc.location)
+		})
+	}
+}
+
+func TestRedirectRulesFirstMatchWins(t *testing.T) {
+	// Test that overlapping rules are checked in order, before the top-level target
+	cfg := redirecterrors.CreateConfig()
+	cfg.Status = []string{"400-499"}
+	cfg.Target = "http://fallback/"
+	cfg.Rules = []redirecterrors.Rule{
+		{Status: []string{"401-403"}, Target: "http://first/"},
+		{Status: []string{"401"}, Target: "http://second/"},
+	}
+
+	ctx := context.Background()
+
+	testCases := []struct {
+		code     int
+		location string
+	}{
+		{401, "http://first/"},
+		{403, "http://first/"},
+		{404, "http://fallback/"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("status_%d", tc.code), func(t *testing.T) {
+			next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				rw.WriteHeader(tc.code)
+			})
+
+			handler, err := redirecterrors.New(ctx, next, cfg, "redirecterrors-plugin")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			recorder := httptest.NewRecorder()
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			handler.ServeHTTP(recorder, req)
+
+			resp := recorder.Result()
+			assertCode(t, resp, 302)
+			assertHeader(t, resp, "Location", tc.location)
+		})
+	}
+}
+
+func TestRuleWithoutTarget(t *testing.T) {
+	cfg := redirecterrors.CreateConfig()
+	cfg.Rules = []redirecterrors.Rule{
+		{Status: []string{"401"}, Target: "http://login/"},
+		{Status: []string{"403"}},
+	}
+
+	ctx := context.Background()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+	_, err := redirecterrors.New(ctx, next, cfg, "redirecterrors-plugin")
+	if !assert(t, err != nil) {
+		return
+	}
+	assert(t, err.Error() == "rule 1: target url must be set")
+}
+
+func TestExcludePaths(t *testing.T) {
+	// Test that excluded paths pass the caught status through
+	cfg := redirecterrors.CreateConfig()
+	cfg.Status = []string{"401"}
+	cfg.Target = "http://target/"
+	cfg.ExcludePaths = []string{"/api/*", "/healthz", "regex:^/metrics(/.*)?$"}
+
+	ctx := context.Background()
+
+	testCases := []struct {
+		path     string
+		expected int
+	}{
+		{"/", 302},
+		{"/app/page", 302},
+		{"/api/v1/users", 401},
+		{"/api", 302},
+		{"/healthz", 401},
+		{"/healthz/deep", 302},
+		{"/metrics", 401},
+		{"/metrics/extra", 401},
+		{"/metricsx", 302},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.path, func(t *testing.T) {
+			next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				rw.WriteHeader(401)
+			})
+
+			handler, err := redirecterrors.New(ctx, next, cfg, "redirecterrors-plugin")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			recorder := httptest.NewRecorder()
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost"+tc.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			handler.ServeHTTP(recorder, req)
+
+			assertCode(t, recorder.Result(), tc.expected)
+		})
+	}
+}
+
+func TestRulePaths(t *testing.T) {
+	// Test that rules only apply to their included paths
+	cfg := redirecterrors.CreateConfig()
+	cfg.Rules = []redirecterrors.Rule{
+		{Status: []string{"401"}, Target: "http://admin-login/", IncludePaths: []string{"/admin/*"}},
+		{Status: []string{"401"}, Target: "http://login/", ExcludePaths: []string{"/public/*"}},
+	}
+
+	ctx := context.Background()
+
+	testCases := []struct {
+		path     string
+		expected int
+		location string
+	}{
+		{"/admin/users", 302, "http://admin-login/"},
+		{"/app", 302, "http://login/"},
+		{"/public/file", 401, ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.path, func(t *testing.T) {
+			next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				rw.WriteHeader(401)
+			})
+
+			handler, err := redirecterrors.New(ctx, next, cfg, "redirecterrors-plugin")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			recorder := httptest.NewRecorder()
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost"+tc.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			handler.ServeHTTP(recorder, req)
+
+			resp := recorder.Result()
+			assertCode(t, resp, tc.expected)
+			assertHeader(t, resp, "Location", tc.location)
+		})
+	}
+}
+
+func TestInvalidPathPattern(t *testing.T) {
+	cfg := redirecterrors.CreateConfig()
+	cfg.Status = []string{"401"}
+	cfg.Target = "http://target/"
+	cfg.IncludePaths = []string{"regex:[invalid("}
+
+	ctx := context.Background()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+	_, err := redirecterrors.New(ctx, next, cfg, "redirecterrors-plugin")
+	if err == nil {
+		t.Fatal("expected error for invalid path pattern, got nil")
+	}
+}
+
+func TestProblemDetailsForAPIClients(t *testing.T) {
+	// Test that API clients get a problem document while browsers keep getting the redirect
+	cfg := redirecterrors.CreateConfig()
+	cfg.Status = []string{"401"}
+	cfg.Target = "http://login/?url={url}"
+	cfg.ProblemDetails = true
+
+	ctx := context.Background()
+
+	testCases := []struct {
+		name    string
+		headers map[string]string
+		problem bool
+	}{
+		{"browser", map[string]string{"Accept": "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8"}, false},
+		{"no accept", map[string]string{}, false},
+		{"wildcard", map[string]string{"Accept": "*/*"}, false},
+		{"json", map[string]string{"Accept": "application/json"}, true},
+		{"json preferred", map[string]string{"Accept": "application/json, text/html;q=0.5"}, true},
+		{"html preferred", map[string]string{"Accept": "application/json;q=0.5, text/html"}, false},
+		{"problem json", map[string]string{"Accept": "application/problem+json"}, true},
+		{"xhr", map[string]string{"X-Requested-With": "XMLHttpRequest"}, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				rw.Header().Set("Location", "/up")
+				rw.WriteHeader(401)
+			})
+
+			handler, err := redirecterrors.New(ctx, next, cfg, "redirecterrors-plugin")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			recorder := httptest.NewRecorder()
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost/app", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for key, value := range tc.headers {
+				req.Header.Set(key, value)
+			}
+
+			handler.ServeHTTP(recorder, req)
+
+			resp := recorder.Result()
+			if !tc.problem {
+				assertCode(t, resp, 302)
+				assertHeader(t, resp, "Location", "http://login/?url=http://localhost/app")
+				return
+			}
+
+			assertCode(t, resp, 401)
+			assertHeader(t, resp, "Content-Type", "application/problem+json")
+			assertNoHeader(t, resp, "Location")
+
+			var problem map[string]interface{}
+			if err := json.Unmarshal(recorder.Body.Bytes(), &problem); err != nil {
+				t.Fatal(err)
+			}
+			if problem["status"] != float64(401) {
+				t.Errorf("expected status 401, got %v", problem["status"])
+			}
+			if problem["title"] != "Unauthorized" {
+				t.Errorf("expected title 'Unauthorized', got %v", problem["title"])
+			}
+			if problem["location"] != "http://login/?url=http://localhost/app" {
+				t.Errorf("unexpected location %v", problem["location"])
+			}
+		})
+	}
+}
+
+func TestProblemDetailsDisabled(t *testing.T) {
+	// Test that API clients are redirected when problemDetails is off
+	cfg := redirecterrors.CreateConfig()
+	cfg.Status = []string{"401"}
+	cfg.Target = "http://login/"
+
+	ctx := context.Background()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(401)
+	})
+
+	handler, err := redirecterrors.New(ctx, next, cfg, "redirecterrors-plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	handler.ServeHTTP(recorder, req)
+
+	resp := recorder.Result()
+	assertCode(t, resp, 302)
+	assertHeader(t, resp, "Location", "http://login/")
+}
+
+func TestAllowedHosts(t *testing.T) {
+	// Test that spoofed forwarded hosts and disallowed targets are rejected
+	ctx := context.Background()
+
+	testCases := []struct {
+		name     string
+		target   string
+		host     string
+		fallback string
+		expected int
+		location string
+	}{
+		{"exact host", "https://login.example.com/?rd={url}", "example.com", "", 302, "https://login.example.com/?rd=https://example.com/app"},
+		{"wildcard host", "https://login.example.com/?rd={url}", "app.example.com", "", 302, "https://login.example.com/?rd=https://app.example.com/app"},
+		{"host with port", "https://login.example.com/", "app.example.com:8443", "", 302, "https://login.example.com/"},
+		{"spoofed host", "https://login.example.com/?rd={url}", "evil.com", "", 401, ""},
+		{"suffix trick", "https://login.example.com/?rd={url}", "evilexample.com", "", 401, ""},
+		{"spoofed host with fallback", "https://login.example.com/?rd={url}", "evil.com", "https://login.example.com/", 302, "https://login.example.com/"},
+		{"target from host", "https://{host}/login", "evil.com", "", 401, ""},
+		{"relative target", "/login?rd={url}", "example.com", "", 302, "/login?rd=https://example.com/app"},
+		{"scheme relative target", "//evil.com/x", "example.com", "", 401, ""},
+		{"backslash target", "/\\evil.com/x", "example.com", "", 401, ""},
+		{"double backslash target", "\\\\evil.com/x", "example.com", "", 401, ""},
+		{"mixed slashes target", "https:/\\evil.com", "example.com", "", 401, ""},
+		{"opaque target", "https:evil.com", "example.com", "", 401, ""},
+		{"javascript target", "javascript:alert(1)", "example.com", "", 401, ""},
+		{"path relative target", "login", "example.com", "", 401, ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := redirecterrors.CreateConfig()
+			cfg.Status = []string{"401"}
+			cfg.Target = tc.target
+			cfg.AllowedHosts = []string{"example.com", "*.example.com"}
+			cfg.FallbackURL = tc.fallback
+
+			next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				rw.Header().Set("Content-Length", "12")
+				rw.Header().Set("Content-Type", "text/plain")
+				rw.Header().Set("WWW-Authenticate", "Bearer")
+				rw.WriteHeader(401)
+				_, _ = rw.Write([]byte("unauthorized"))
+			})
+
+			handler, err := redirecterrors.New(ctx, next, cfg, "redirecterrors-plugin")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			recorder := httptest.NewRecorder()
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost/app", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("X-Forwarded-Proto", "https")
+			req.Header.Set("X-Forwarded-Host", tc.host)
+
+			handler.ServeHTTP(recorder, req)
+
+			resp := recorder.Result()
+			assertCode(t, resp, tc.expected)
+			assertHeader(t, resp, "Location", tc.location)
+			if tc.expected == 401 {
+				// The body of the caught response is dropped, along with the headers describing it
+				assertNoHeader(t, resp, "Content-Length")
+				assertNoHeader(t, resp, "Content-Type")
+				assertHeader(t, resp, "WWW-Authenticate", "Bearer")
+				if recorder.Body.Len() != 0 {
+					t.Errorf("expected no body, got %q", recorder.Body.String())
+				}
+			}
+		})
+	}
+}
+
+func TestInvalidAllowedHost(t *testing.T) {
+	cfg := redirecterrors.CreateConfig()
+	cfg.Status = []string{"401"}
+	cfg.Target = "http://target/"
+	cfg.AllowedHosts = []string{"evil*.com"}
+
+	ctx := context.Background()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+	_, err := redirecterrors.New(ctx, next, cfg, "redirecterrors-plugin")
+	if err == nil {
+		t.Fatal("expected error for invalid allowed host, got nil")
+	}
+}
+
+func TestSignedURL(t *testing.T) {
+	// Test that {signed_url} carries a return URL the portal can verify
+	secretFile := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(secretFile, []byte("current-secret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := redirecterrors.CreateConfig()
+	cfg.Status = []string{"401"}
+	cfg.Target = "http://login/?rd={signed_url}"
+	cfg.SigningSecretFile = secretFile
+
+	ctx := context.Background()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(401)
+	})
+
+	handler, err := redirecterrors.New(ctx, next, cfg, "redirecterrors-plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost/app?x=1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Forwarded-Proto", "https")
+	req.Header.Set("X-Forwarded-Host", "example.com")
+
+	handler.ServeHTTP(recorder, req)
+
+	resp := recorder.Result()
+	assertCode(t, resp, 302)
+
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := location.Query()
+	if query.Get("rd") != "https://example.com/app?x=1" {
+		t.Errorf("unexpected return url '%s'", query.Get("rd"))
+	}
+
+	// The portal recomputes the signature with the current secret
+	if query.Get("sig") != signature("current-secret", query.Get("rd"), query.Get("exp")) {
+		t.Errorf("unexpected signature '%s'", query.Get("sig"))
+	}
+	if query.Get("sig") == signature("previous-secret", query.Get("rd"), query.Get("exp")) {
+		t.Error("signature should not match another secret")
+	}
+	if query.Get("sig") == signature("current-secret", "https://evil.com/", query.Get("exp")) {
+		t.Error("signature should not match another url")
+	}
+
+	exp, err := strconv.ParseInt(query.Get("exp"), 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if remaining := time.Until(time.Unix(exp, 0)); remaining <= 9*time.Minute || remaining > 10*time.Minute {
+		t.Errorf("expected an expiry in 10 minutes, got %v", remaining)
+	}
+}
+
+// signature computes the signature of a return URL as an auth portal would.
+func signature(secret, rawURL, exp string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(rawURL + "\n" + exp))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestSignaturePlaceholders(t *testing.T) {
+	// Test that {exp} and {sig} can be placed in custom parameters
+	cfg := redirecterrors.CreateConfig()
+	cfg.Status = []string{"401"}
+	cfg.Target = "http://login/?return={uri}&e={exp}&s={sig}"
+	cfg.SigningSecret = "secret"
+	cfg.SignatureTTL = "1m"
+
+	ctx := context.Background()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(401)
+	})
+
+	handler, err := redirecterrors.New(ctx, next, cfg, "redirecterrors-plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost/app", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler.ServeHTTP(recorder, req)
+
+	location, err := url.Parse(recorder.Result().Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := location.Query()
+	if query.Get("s") != signature("secret", query.Get("return"), query.Get("e")) {
+		t.Errorf("unexpected signature '%s'", query.Get("s"))
+	}
+}
+
+func TestSignedURLWithoutSecret(t *testing.T) {
+	cfg := redirecterrors.CreateConfig()
+	cfg.Status = []string{"401"}
+	cfg.Target = "http://login/?rd={signed_url}"
+
+	ctx := context.Background()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+	_, err := redirecterrors.New(ctx, next, cfg, "redirecterrors-plugin")
+	if err == nil {
+		t.Fatal("expected error for signed url without secret, got nil")
+	}
+}
+
+func TestReturnCookie(t *testing.T) {
+	// Test that the return path restores the original URL stored in the return cookie
+	cfg := redirecterrors.CreateConfig()
+	cfg.Status = []string{"401"}
+	cfg.Target = "http://login/?rd={return_url}"
+	cfg.ReturnCookieSecret = "secret"
+
+	ctx := context.Background()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(401)
+	})
+
+	handler, err := redirecterrors.New(ctx, next, cfg, "redirecterrors-plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost/orders?id=42", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Forwarded-Proto", "https")
+	req.Header.Set("X-Forwarded-Host", "example.com")
+
+	handler.ServeHTTP(recorder, req)
+
+	resp := recorder.Result()
+	assertCode(t, resp, 302)
+	assertHeader(t, resp, "Location", "http://login/?rd="+url.QueryEscape("https://example.com/_redirecterrors/return"))
+
+	var returnCookie *http.Cookie
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == "redirecterrors_return" {
+			returnCookie = cookie
+		}
+	}
+	if returnCookie == nil {
+		t.Fatal("return cookie not set")
+	}
+	if !returnCookie.HttpOnly || !returnCookie.Secure {
+		t.Error("return cookie should be HttpOnly and Secure")
+	}
+
+	// Coming back from the login page
+	recorder = httptest.NewRecorder()
+	req, err = http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost/_redirecterrors/return", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.AddCookie(&http.Cookie{Name: returnCookie.Name, Value: returnCookie.Value})
+
+	handler.ServeHTTP(recorder, req)
+
+	resp = recorder.Result()
+	assertCode(t, resp, 302)
+	assertHeader(t, resp, "Location", "https://example.com/orders?id=42")
+	assertHeader(t, resp, "Content-Type", "text/plain; charset=utf-8")
+	assertHeader(t, resp, "Content-Length", fmt.Sprint(recorder.Body.Len()))
+
+	cleared := false
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == "redirecterrors_return" && cookie.Value == "" {
+			cleared = true
+		}
+	}
+	if !cleared {
+		t.Error("return cookie should be cleared")
+	}
+}
+
+func TestReturnCookieFallback(t *testing.T) {
+	// Test that a redirect to the fallback URL stores neither the rejected URL nor the form
+	cfg := redirecterrors.CreateConfig()
+	cfg.Status = []string{"401"}
+	cfg.Target = "https://login.example.com/?rd={return_url}"
+	cfg.AllowedHosts = []string{"example.com", "*.example.com"}
+	cfg.FallbackURL = "https://login.example.com/"
+	cfg.ReturnCookieSecret = "secret"
+	cfg.ReplayPost = true
+
+	ctx := context.Background()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(401)
+	})
+
+	handler, err := redirecterrors.New(ctx, next, cfg, "redirecterrors-plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://localhost/comments", strings.NewReader("comment=Hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-Forwarded-Proto", "https")
+	req.Header.Set("X-Forwarded-Host", "evil.com")
+	req.Header.Set("Origin", "https://evil.com")
+
+	handler.ServeHTTP(recorder, req)
+
+	resp := recorder.Result()
+	assertCode(t, resp, 302)
+	assertHeader(t, resp, "Location", "https://login.example.com/")
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == "redirecterrors_return" {
+			t.Errorf("unexpected return cookie %q", cookie.Value)
+		}
+	}
+}
+
+func TestReturnCookieInvalid(t *testing.T) {
+	// Test that a missing or tampered return cookie is rejected
+	testCases := []struct {
+		name     string
+		cookie   string
+		fallback string
+		expected int
+		location string
+	}{
+		{"missing", "", "", 400, ""},
+		{"tampered", "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA", "", 400, ""},
+		{"fallback", "garbage", "http://home/", 302, "http://home/"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := redirecterrors.CreateConfig()
+			cfg.Status = []string{"401"}
+			cfg.Target = "http://login/"
+			cfg.ReturnCookieSecret = "secret"
+			cfg.ReturnPath = "/callback"
+			cfg.FallbackURL = tc.fallback
+
+			ctx := context.Background()
+			next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				t.Error("return path should not reach the next handler")
+			})
+
+			handler, err := redirecterrors.New(ctx, next, cfg, "redirecterrors-plugin")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			recorder := httptest.NewRecorder()
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost/callback", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(tc.cookie) != 0 {
+				req.AddCookie(&http.Cookie{Name: "redirecterrors_return", Value: tc.cookie})
+			}
+
+			handler.ServeHTTP(recorder, req)
+
+			resp := recorder.Result()
+			assertCode(t, resp, tc.expected)
+			assertHeader(t, resp, "Location", tc.location)
+			assertHeader(t, resp, "Content-Type", "text/plain; charset=utf-8")
+			assertHeader(t, resp, "Content-Length", fmt.Sprint(recorder.Body.Len()))
+		})
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	// Test that outcomes and upstream durations are exposed on the metrics path
+	cfg := redirecterrors.CreateConfig()
+	cfg.Rules = []redirecterrors.Rule{
+		{Name: "login", Status: []string{"401"}, Target: "http://login/"},
+	}
+	cfg.ExcludePaths = []string{"/api/*"}
+	cfg.MetricsPath = "/_metrics"
+
+	ctx := context.Background()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/ok" {
+			rw.WriteHeader(200)
+			return
+		}
+		rw.WriteHeader(401)
+	})
+
+	handler, err := redirecterrors.New(ctx, next, cfg, "metrics-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"/app", "/app", "/ok", "/api/users"} {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost"+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	recorder := httptest.NewRecorder()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost/_metrics", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler.ServeHTTP(recorder, req)
+
+	resp := recorder.Result()
+	assertCode(t, resp, 200)
+	assertHeader(t, resp, "Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	body := recorder.Body.String()
+	expectedLines := []string{
+		`redirecterrors_requests_total{middleware="metrics-test",status="401",rule="login",outcome="redirected"} 2`,
+		`redirecterrors_requests_total{middleware="metrics-test",status="200",rule="",outcome="passed_through"} 1`,
+		`redirecterrors_requests_total{middleware="metrics-test",status="",rule="",outcome="bypassed"} 1`,
+		`redirecterrors_upstream_duration_seconds_bucket{middleware="metrics-test",le="+Inf"} 4`,
+		`redirecterrors_upstream_duration_seconds_count{middleware="metrics-test"} 4`,
+	}
+	for _, line := range expectedLines {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("missing metrics line %s in:\n%s", line, body)
+		}
+	}
+}
+
+func TestHTMLOutputMode(t *testing.T) {
+	// Test that the interstitial page carries the target with a fragment placeholder for the script
+	cfg := redirecterrors.CreateConfig()
+	cfg.Status = []string{"401"}
+	cfg.Target = "http://login/?rd={uri}&s={status}"
+	cfg.OutputMode = "html"
+
+	ctx := context.Background()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Location", "/up")
+		rw.WriteHeader(401)
+	})
+
+	handler, err := redirecterrors.New(ctx, next, cfg, "redirecterrors-plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost/app", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler.ServeHTTP(recorder, req)
+
+	resp := recorder.Result()
+	assertCode(t, resp, 200)
+	assertHeader(t, resp, "Content-Type", "text/html; charset=utf-8")
+	assertHeader(t, resp, "Cache-Control", "no-store")
+	assertNoHeader(t, resp, "Location")
+
+	body := recorder.Body.String()
+	expected := []string{
+		`var target = "http://login/?rd=http%3A%2F%2Flocalhost%2Fapp__REDIRECTERRORS_FRAGMENT__\u0026s=401";`,
+		`.split("__REDIRECTERRORS_FRAGMENT__")`,
+		`<meta http-equiv="refresh" content="0;url=http://login/?rd=http%3A%2F%2Flocalhost%2Fapp&amp;s=401">`,
+	}
+	for _, fragment := range expected {
+		if !strings.Contains(body, fragment) {
+			t.Errorf("missing %s in:\n%s", fragment, body)
+		}
+	}
+}
+
+func TestInvalidOutputMode(t *testing.T) {
+	cfg := redirecterrors.CreateConfig()
+	cfg.Status = []string{"401"}
+	cfg.Target = "http://target/"
+	cfg.OutputMode = "javascript"
+
+	ctx := context.Background()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+	_, err := redirecterrors.New(ctx, next, cfg, "redirecterrors-plugin")
+	if err == nil {
+		t.Fatal("expected error for invalid output mode, got nil")
+	}
+}
+
+func TestOutputBodyTemplate(t *testing.T) {
+	// Test that the body template is expanded, with values escaped for HTML
+	cfg := redirecterrors.CreateConfig()
+	cfg.Status = []string{"401"}
+	cfg.Target = "http://login/?rd={uri}&a=b"
+	cfg.OutputBody = `<p>Error {status}, <a href="{location}">sign in</a> to open {url}</p>`
+	cfg.OutputContentType = "text/html; charset=utf-8"
+
+	ctx := context.Background()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(401)
+	})
+
+	handler, err := redirecterrors.New(ctx, next, cfg, "redirecterrors-plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost/app?q=<script>", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler.ServeHTTP(recorder, req)
+
+	resp := recorder.Result()
+	assertCode(t, resp, 302)
+	assertHeader(t, resp, "Content-Type", "text/html; charset=utf-8")
+
+	expected := `<p>Error 401, <a href="http://login/?rd=http%3A%2F%2Flocalhost%2Fapp%3Fq%3D%3Cscript%3E&amp;a=b">sign in</a> to open http://localhost/app?q=&lt;script&gt;</p>`
+	if recorder.Body.String() != expected {
+		t.Errorf("expected '%s', got '%s'", expected, recorder.Body.String())
+	}
+}
+
+func TestOutputBodyTemplateJSON(t *testing.T) {
+	// Test that values are escaped as JSON strings for JSON content types
+	for _, contentType := range []string{"application/json", "application/problem+json; charset=utf-8"} {
+		t.Run(contentType, func(t *testing.T) {
+			cfg := redirecterrors.CreateConfig()
+			cfg.Status = []string{"401"}
+			cfg.Target = "http://login/"
+			cfg.OutputBody = `{"status": {status}, "tenant": "{header:X-Tenant}", "location": "{location}"}`
+			cfg.OutputContentType = contentType
+
+			ctx := context.Background()
+			next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				rw.WriteHeader(401)
+			})
+
+			handler, err := redirecterrors.New(ctx, next, cfg, "redirecterrors-plugin")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			recorder := httptest.NewRecorder()
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost/", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("X-Tenant", `acme", "admin": true, "x": "\`)
+
+			handler.ServeHTTP(recorder, req)
+
+			var document map[string]interface{}
+			if err := json.Unmarshal(recorder.Body.Bytes(), &document); err != nil {
+				t.Fatalf("invalid JSON body %q: %v", recorder.Body.String(), err)
+			}
+			if document["tenant"] != `acme", "admin": true, "x": "\` {
+				t.Errorf("unexpected tenant %q", document["tenant"])
+			}
+			if _, ok := document["admin"]; ok {
+				t.Error("header value injected a field")
+			}
+			if document["status"] != float64(401) {
+				t.Errorf("unexpected status %v", document["status"])
+			}
+		})
+	}
+}
+
+func TestOutputBodyFile(t *testing.T) {
+	// Test that the body template can be read from a file
+	bodyFile := filepath.Join(t.TempDir(), "body.txt")
+	if err := os.WriteFile(bodyFile, []byte("Go to {location}"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := redirecterrors.CreateConfig()
+	cfg.Status = []string{"401"}
+	cfg.Target = "http://login/?s={status}"
+	cfg.OutputBodyFile = bodyFile
+
+	ctx := context.Background()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(401)
+	})
+
+	handler, err := redirecterrors.New(ctx, next, cfg, "redirecterrors-plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler.ServeHTTP(recorder, req)
+
+	resp := recorder.Result()
+	assertHeader(t, resp, "Content-Type", "text/plain; charset=utf-8")
+	if recorder.Body.String() != "Go to http://login/?s=401" {
+		t.Errorf("unexpected body '%s'", recorder.Body.String())
+	}
+}
+
+func TestOutputBodyAndFile(t *testing.T) {
+	cfg := redirecterrors.CreateConfig()
+	cfg.Status = []string{"401"}
+	cfg.Target = "http://target/"
+	cfg.OutputBody = "inline"
+	cfg.OutputBodyFile = "/nonexistent"
+
+	ctx := context.Background()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+	_, err := redirecterrors.New(ctx, next, cfg, "redirecterrors-plugin")
+	if err == nil {
+		t.Fatal("expected error for both outputBody and outputBodyFile, got nil")
+	}
+}
+
+func TestRequestPlaceholders(t *testing.T) {
+	// Test the placeholders derived from the request
+	cfg := redirecterrors.CreateConfig()
+	cfg.Status = []string{"401"}
+	cfg.Target = "http://login/{path}?{query}&m={method}&tenant={header:X-Tenant}&locale={cookie:locale}&id={query:id}&ip={remote_ip}&rid={request_id}&missing={cookie:none}"
+
+	ctx := context.Background()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(401)
+	})
+
+	handler, err := redirecterrors.New(ctx, next, cfg, "redirecterrors-plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://localhost/orders/42?id=7&x=y", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.RemoteAddr = "192.0.2.10:51234"
+	req.Header.Set("X-Tenant", "acme")
+	req.Header.Set("X-Request-Id", "req-1")
+	req.AddCookie(&http.Cookie{Name: "locale", Value: "fr"})
+
+	handler.ServeHTTP(recorder, req)
+
+	resp := recorder.Result()
+	assertCode(t, resp, 302)
+	expected := "http://login//orders/42?id=7&x=y&m=POST&tenant=acme&locale=fr&id=7&ip=192.0.2.10&rid=req-1&missing="
+	if resp.Header.Get("Location") != expected {
+		t.Errorf("expected location '%s', got '%s'", expected, resp.Header.Get("Location"))
+	}
+}
+
+func TestPlaceholderValuesNotExpandedTwice(t *testing.T) {
+	// Test that a header value containing a placeholder is not expanded again
+	cfg := redirecterrors.CreateConfig()
+	cfg.Status = []string{"401"}
+	cfg.Target = "http://login/?tenant={header:X-Tenant}"
+
+	ctx := context.Background()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(401)
+	})
+
+	handler, err := redirecterrors.New(ctx, next, cfg, "redirecterrors-plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Tenant", "{status}")
+
+	handler.ServeHTTP(recorder, req)
+
+	assertHeader(t, recorder.Result(), "Location", "http://login/?tenant={status}")
+}
+
+func TestTemplateFilters(t *testing.T) {
+	// Test placeholder pipelines with filters
+	testCases := []struct {
+		target   string
+		expected string
+	}{
+		{"http://login/?rd={url|query}", "http://login/?rd=https%3A%2F%2Fexample.com%2Fa%2Fb%3Fx%3D1"},
+		{"http://login/{url|path}", "http://login/https:%2F%2Fexample.com%2Fa%2Fb%3Fx=1"},
+		{"http://login/?rd={url|base64url}", "http://login/?rd=aHR0cHM6Ly9leGFtcGxlLmNvbS9hL2I_eD0x"},
+		{"http://login/?t={header:X-Tenant|lower|default:acme}", "http://login/?t=globex"},
+		{"http://login/?t={header:X-Missing|lower|default:acme}", "http://login/?t=acme"},
+		{"http://login/?m={method|lower}&M={method|upper}", "http://login/?m=get&M=GET"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.target, func(t *testing.T) {
+			cfg := redirecterrors.CreateConfig()
+			cfg.Status = []string{"401"}
+			cfg.Target = tc.target
+
+			ctx := context.Background()
+			next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				rw.WriteHeader(401)
+			})
+
+			handler, err := redirecterrors.New(ctx, next, cfg, "redirecterrors-plugin")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			recorder := httptest.NewRecorder()
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost/a/b?x=1", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("X-Forwarded-Proto", "https")
+			req.Header.Set("X-Forwarded-Host", "example.com")
+			req.Header.Set("X-Tenant", "GLOBEX")
+
+			handler.ServeHTTP(recorder, req)
+
+			location := recorder.Result().Header.Get("Location")
+			if location != tc.expected {
+				t.Errorf("expected location '%s', got '%s'", tc.expected, location)
+			}
+		})
+	}
+}
+
+func TestTemplateErrors(t *testing.T) {
+	// Test that invalid templates are reported as configuration errors
+	testCases := []struct {
+		name   string
+		target string
+		body   string
+	}{
+		{"unknown placeholder", "http://login/?x={nope}", ""},
+		{"unknown filter", "http://login/?x={url|rot13}", ""},
+		{"missing argument", "http://login/?x={header}", ""},
+		{"unexpected argument", "http://login/?x={status:1}", ""},
+		{"empty argument", "http://login/?x={query:}", ""},
+		{"empty header argument", "http://login/?x={header:}", ""},
+		{"filter argument", "http://login/?x={url|query:zz}", ""},
+		{"default without argument", "http://login/?x={url|default}", ""},
+		{"default empty argument", "http://login/?x={url|default:}", ""},
+		{"filter argument in body", "http://login/", "Go to {location|upper:x}"},
+		{"unterminated", "http://login/?x={url", ""},
+		{"location in target", "http://login/?x={location}", ""},
+		{"return url without secret", "http://login/?x={return_url}", ""},
+		{"unknown filter in body", "http://login/", "Go to {location|rot13}"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := redirecterrors.CreateConfig()
+			cfg.Status = []string{"401"}
+			cfg.Target = tc.target
+			cfg.OutputBody = tc.body
+
+			ctx := context.Background()
+			next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+			_, err := redirecterrors.New(ctx, next, cfg, "redirecterrors-plugin")
+			if err == nil {
+				t.Fatal("expected error, got nil")
+			}
+		})
+	}
+}
+
+func TestTemplateLiteralBraces(t *testing.T) {
+	// Test that braces not starting a placeholder are kept, so JSON bodies work
+	cfg := redirecterrors.CreateConfig()
+	cfg.Status = []string{"401"}
+	cfg.Target = "http://login/"
+	cfg.OutputBody = `{"status": {status}, "location": "{location}"}`
+	cfg.OutputContentType = "application/json"
+
+	ctx := context.Background()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(401)
+	})
+
+	handler, err := redirecterrors.New(ctx, next, cfg, "redirecterrors-plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler.ServeHTTP(recorder, req)
+
+	expected := `{"status": 401, "location": "http://login/"}`
+	if recorder.Body.String() != expected {
+		t.Errorf("expected '%s', got '%s'", expected, recorder.Body.String())
+	}
+}
+
+func TestTemplateLiteralBracesInHTMLBody(t *testing.T) {
+	// Test that compact CSS and scripts in body templates are kept as is
+	cfg := redirecterrors.CreateConfig()
+	cfg.Status = []string{"401"}
+	cfg.Target = "http://login/"
+	cfg.OutputBody = `<style>p{color:red}a{text-decoration:none}</style><script>var f = function(){return 1}; if (x) {y()</script><a href="{location}">{status}</a>`
+	cfg.OutputContentType = "text/html; charset=utf-8"
+
+	ctx := context.Background()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(401)
+	})
+
+	handler, err := redirecterrors.New(ctx, next, cfg, "redirecterrors-plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler.ServeHTTP(recorder, req)
+
+	expected := `<style>p{color:red}a{text-decoration:none}</style><script>var f = function(){return 1}; if (x) {y()</script><a href="http://login/">401</a>`
+	if recorder.Body.String() != expected {
+		t.Errorf("expected '%s', got '%s'", expected, recorder.Body.String())
+	}
+}
+
+func TestOriginalURLFromForwardedHeaders(t *testing.T) {
+	// Test that X-Forwarded-Uri, X-Forwarded-Prefix and X-Forwarded-Port are used to rebuild {url}
+	testCases := []struct {
+		name     string
+		headers  map[string]string
+		expected string
+	}{
+		{"request uri", map[string]string{}, "https://example.com/orders?id=1"},
+		{"forwarded uri", map[string]string{"X-Forwarded-Uri": "/shop/cart?step=2"}, "https://example.com/shop/cart?step=2"},
+		{"invalid forwarded uri", map[string]string{"X-Forwarded-Uri": "cart"}, "https://example.com/orders?id=1"},
+		{"prefix", map[string]string{"X-Forwarded-Prefix": "/app/"}, "https://example.com/app/orders?id=1"},
+		{"prefix and forwarded uri", map[string]string{"X-Forwarded-Prefix": "/app", "X-Forwarded-Uri": "/cart"}, "https://example.com/app/cart"},
+		{"non-default port", map[string]string{"X-Forwarded-Port": "8443"}, "https://example.com:8443/orders?id=1"},
+		{"default port", map[string]string{"X-Forwarded-Port": "443"}, "https://example.com/orders?id=1"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := redirecterrors.CreateConfig()
+			cfg.Status = []string{"401"}
+			cfg.Target = "http://login/?rd={url}&path={path}"
+
+			ctx := context.Background()
+			next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				rw.WriteHeader(401)
+			})
+
+			handler, err := redirecterrors.New(ctx, next, cfg, "redirecterrors-plugin")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			recorder := httptest.NewRecorder()
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost/orders?id=1", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("X-Forwarded-Proto", "https")
+			req.Header.Set("X-Forwarded-Host", "example.com")
+			for key, value := range tc.headers {
+				req.Header.Set(key, value)
+			}
+
+			handler.ServeHTTP(recorder, req)
+
+			rd, err := url.Parse(tc.expected)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := "http://login/?rd=" + tc.expected + "&path=" + rd.Path
+			assertHeader(t, recorder.Result(), "Location", expected)
+		})
+	}
+}
+
+func TestOriginalURLFallbacks(t *testing.T) {
+	// Test the Forwarded header and req.Host/req.TLS fallbacks when X-Forwarded-* headers are missing
+	testCases := []struct {
+		name     string
+		headers  map[string]string
+		tls      bool
+		expected string
+	}{
+		{"forwarded", map[string]string{"Forwarded": `for=192.0.2.60;proto=https;host=example.com, for=198.51.100.17`}, false, "https://example.com/app|https|example.com|192.0.2.1"},
+		{"forwarded quoted", map[string]string{"Forwarded": `For="[2001:db8:cafe::17]:4711";Proto=https;Host="example.com:8443"`}, false, "https://example.com:8443/app|https|example.com:8443|192.0.2.1"},
+		{"x-forwarded wins", map[string]string{"Forwarded": "proto=http;host=other.com", "X-Forwarded-Proto": "https", "X-Forwarded-Host": "example.com"}, false, "https://example.com/app|https|example.com|192.0.2.1"},
+		{"partial x-forwarded", map[string]string{"Forwarded": "proto=https;host=other.com", "X-Forwarded-Host": "example.com"}, false, "https://example.com/app|https|example.com|192.0.2.1"},
+		{"obfuscated for", map[string]string{"Forwarded": "for=_hidden;proto=https"}, false, "https://backend.local/app|https|backend.local|192.0.2.1"},
+		{"x-forwarded-for", map[string]string{"X-Forwarded-For": "198.51.100.17"}, false, "http://backend.local/app|http|backend.local|192.0.2.1"},
+		{"request host", map[string]string{}, false, "http://backend.local/app|http|backend.local|192.0.2.1"},
+		{"request tls", map[string]string{}, true, "https://backend.local/app|https|backend.local|192.0.2.1"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := redirecterrors.CreateConfig()
+			cfg.Status = []string{"401"}
+			cfg.Target = "http://login/?rd={url}|{proto}|{host}|{remote_ip}"
+
+			ctx := context.Background()
+			next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				rw.WriteHeader(401)
+			})
+
+			handler, err := redirecterrors.New(ctx, next, cfg, "redirecterrors-plugin")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Server-side request, as received by Traefik
+			req := httptest.NewRequest(http.MethodGet, "/app", nil)
+			req.Host = "backend.local"
+			req.RemoteAddr = "192.0.2.1:1234"
+			if tc.tls {
+				req.TLS = &tls.ConnectionState{}
+			}
+			for key, value := range tc.headers {
+				req.Header.Set(key, value)
+			}
+
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, req)
+
+			assertHeader(t, recorder.Result(), "Location", "http://login/?rd="+tc.expected)
+		})
+	}
+}
+
+func TestTrustedProxies(t *testing.T) {
+	testCases := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		expected   string
+	}{
+		{"trusted proxy", "10.0.0.1:1234", map[string]string{"X-Forwarded-Proto": "https", "X-Forwarded-Host": "example.com", "X-Forwarded-For": "203.0.113.7, 10.0.0.2"}, "https://example.com/app|203.0.113.7"},
+		{"untrusted client", "203.0.113.7:1234", map[string]string{"X-Forwarded-Proto": "https", "X-Forwarded-Host": "evil.com", "X-Forwarded-For": "198.51.100.1"}, "http://backend.local/app|203.0.113.7"},
+		{"spoofed hop", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "198.51.100.1, 203.0.113.7"}, "http://backend.local/app|203.0.113.7"},
+		{"all hops trusted", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "10.0.0.3, 10.0.0.2"}, "http://backend.local/app|10.0.0.3"},
+		{"forwarded for", "192.0.2.10:1234", map[string]string{"Forwarded": `for=203.0.113.7, for="[2001:db8::1]"`}, "http://backend.local/app|2001:db8::1"},
+		{"no forwarded for", "10.0.0.1:1234", map[string]string{}, "http://backend.local/app|10.0.0.1"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := redirecterrors.CreateConfig()
+			cfg.Status = []string{"401"}
+			cfg.Target = "http://login/?rd={url}|{remote_ip}"
+			cfg.TrustedProxies = []string{"10.0.0.0/8", "192.0.2.10"}
+
+			ctx := context.Background()
+			next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				rw.WriteHeader(401)
+			})
+
+			handler, err := redirecterrors.New(ctx, next, cfg, "redirecterrors-plugin")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/app", nil)
+			req.Host = "backend.local"
+			req.RemoteAddr = tc.remoteAddr
+			for key, value := range tc.headers {
+				req.Header.Set(key, value)
+			}
+
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, req)
+
+			assertHeader(t, recorder.Result(), "Location", "http://login/?rd="+tc.expected)
+		})
+	}
+}
+
+func TestInvalidTrustedProxy(t *testing.T) {
+	cfg := redirecterrors.CreateConfig()
+	cfg.Status = []string{"401"}
+	cfg.Target = "http://login/"
+	cfg.TrustedProxies = []string{"10.0.0.0/33"}
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+	_, err := redirecterrors.New(context.Background(), next, cfg, "redirecterrors-plugin")
+	if err == nil || !strings.Contains(err.Error(), "invalid trusted proxy '10.0.0.0/33'") {
+		t.Errorf("expected invalid trusted proxy error, got %v", err)
+	}
+}
+
+func TestNewHTTPCodeRangesSyntax(t *testing.T) {
+	testCases := []struct {
+		name    string
+		status  []string
+		match   []int
+		nomatch []int
+	}{
+		{"whitespace", []string{" 401 ", " 500 - 503 "}, []int{401, 500, 503}, []int{402, 504}},
+		{"class", []string{"4xx"}, []int{400, 451, 499}, []int{399, 500}},
+		{"list", []string{"401, 403,500-502"}, []int{401, 403, 501}, []int{402, 503}},
+		{"negation", []string{"4xx", "!404"}, []int{400, 403, 405, 499}, []int{404, 500}},
+		{"negated range", []string{"!401-403, 400-499"}, []int{400, 404}, []int{401, 402, 403}},
+		{"negated class", []string{"400-599", "!5XX"}, []int{400, 499}, []int{500, 599}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ranges, err := redirecterrors.NewHTTPCodeRanges(tc.status)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, code := range tc.match {
+				if !ranges.Contains(code) {
+					t.Errorf("Contains(%d) = false, want true", code)
+				}
+			}
+			for _, code := range tc.nomatch {
+				if ranges.Contains(code) {
+					t.Errorf("Contains(%d) = true, want false", code)
+				}
+			}
+		})
+	}
+}
+
+func TestNewHTTPCodeRangesErrors(t *testing.T) {
+	testCases := []struct {
+		status   string
+		expected string
+	}{
+		{"500-400", "invalid status code range '500-400'"},
+		{"-1", "invalid status code range '-1'"},
+		{"999", "invalid status code range '999'"},
+		{"99", "invalid status code range '99'"},
+		{"4-5-6", "invalid status code range '4-5-6'"},
+		{"401,,403", "invalid status code range ''"},
+		{"6xx", "invalid status code range '6xx'"},
+		{"+404", "invalid status code range '+404'"},
+		{"!404", "need a range to exclude codes from"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.status, func(t *testing.T) {
+			_, err := redirecterrors.NewHTTPCodeRanges([]string{tc.status})
+			if err == nil || !strings.Contains(err.Error(), tc.expected) {
+				t.Errorf("expected error containing %q, got %v", tc.expected, err)
+			}
+		})
+	}
+}
+
+func TestHTTPCodeRangesNormalize(t *testing.T) {
+	ranges, err := redirecterrors.NewHTTPCodeRanges([]string{"500-503", "404", "401-403", "502-599", "400"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ranges.String() != "400-404,500-599" {
+		t.Errorf("expected 400-404,500-599, got %s", ranges.String())
+	}
+	if len(ranges) != 2 || ranges[0] != [2]int{400, 404} || ranges[1] != [2]int{500, 599} {
+		t.Errorf("unexpected normalized ranges %v", ranges)
+	}
+
+	unsorted := redirecterrors.HTTPCodeRanges{{503, 503}, {401, 401}, {500, 502}}
+	if unsorted.String() != "401,500-503" {
+		t.Errorf("expected 401,500-503, got %s", unsorted.String())
+	}
+}
+
+func TestHTTPCodeRangesSetOperations(t *testing.T) {
+	clientErrors := redirecterrors.HTTPCodeRanges{{400, 499}}
+	auth := redirecterrors.HTTPCodeRanges{{401, 401}, {403, 403}}
+
+	testCases := []struct {
+		name     string
+		ranges   redirecterrors.HTTPCodeRanges
+		expected string
+	}{
+		{"union", auth.Union(redirecterrors.HTTPCodeRanges{{402, 402}, {500, 599}}), "401-403,500-599"},
+		{"subtract", clientErrors.Subtract(auth), "400,402,404-499"},
+		{"subtract all", auth.Subtract(clientErrors), ""},
+		{"complement", clientErrors.Complement(), "100-399,500-599"},
+		{"complement empty", redirecterrors.HTTPCodeRanges{}.Complement(), "100-599"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.ranges.String() != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, tc.ranges.String())
+			}
+		})
+	}
+}
+
+func TestHTTPCodeRangesTextMarshalling(t *testing.T) {
+	var config struct {
+		Status redirecterrors.HTTPCodeRanges `json:"status"`
+	}
+
+	err := json.Unmarshal([]byte(`{"status":"5xx, 401, !503"}`), &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !config.Status.Contains(401) || !config.Status.Contains(500) || config.Status.Contains(503) {
+		t.Errorf("unexpected ranges %v", config.Status)
+	}
+
+	out, err := json.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != `{"status":"401,500-502,504-599"}` {
+		t.Errorf("unexpected JSON %s", out)
+	}
+
+	err = json.Unmarshal([]byte(`{"status":"600"}`), &config)
+	if err == nil || !strings.Contains(err.Error(), "invalid status code range '600'") {
+		t.Errorf("expected invalid status code range error, got %v", err)
+	}
+
+	// Empty ranges survive a round trip
+	config.Status = nil
+	out, err = json.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Status = redirecterrors.HTTPCodeRanges{{401, 401}}
+	if err := json.Unmarshal(out, &config); err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Status) != 0 {
+		t.Errorf("expected empty ranges, got %v", config.Status)
+	}
+}
+
+func TestHeaderTriggers(t *testing.T) {
+	testCases := []struct {
+		name           string
+		headers        map[string]string
+		expectedCode   int
+		expectedTarget string
+	}{
+		{"exact value", map[string]string{"X-Redirect-Required": "TRUE"}, 302, "http://login/?status=200"},
+		{"other value", map[string]string{"X-Redirect-Required": "false"}, 200, ""},
+		{"regex", map[string]string{"X-Auth-Reason": "expired"}, 302, "http://reauth/"},
+		{"regex no match", map[string]string{"X-Auth-Reason": "expired-soon"}, 200, ""},
+		{"presence", map[string]string{"X-Logout": ""}, 302, "http://logout/"},
+		{"no header", map[string]string{}, 200, ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := redirecterrors.CreateConfig()
+			cfg.Status = []string{"401"}
+			cfg.HeaderTriggers = []redirecterrors.HeaderTrigger{{Header: "x-redirect-required", Value: "true"}}
+			cfg.Target = "http://login/?status={status}"
+			cfg.Rules = []redirecterrors.Rule{
+				{
+					HeaderTriggers: []redirecterrors.HeaderTrigger{{Header: "X-Auth-Reason", Value: "regex:^(expired|revoked)$"}},
+					Target:         "http://reauth/",
+				},
+				{
+					HeaderTriggers: []redirecterrors.HeaderTrigger{{Header: "X-Logout"}},
+					Target:         "http://logout/",
+				},
+			}
+
+			ctx := context.Background()
+			next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				for key, value := range tc.headers {
+					rw.Header()[key] = []string{value}
+				}
+				rw.Header().Set("Content-Type", "application/json")
+				_, _ = rw.Write([]byte(`{"ok":true}`))
+			})
+
+			handler, err := redirecterrors.New(ctx, next, cfg, "redirecterrors-plugin")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			recorder := httptest.NewRecorder()
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost/app", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			handler.ServeHTTP(recorder, req)
+
+			assertCode(t, recorder.Result(), tc.expectedCode)
+			if len(tc.expectedTarget) == 0 {
+				assertNoHeader(t, recorder.Result(), "Location")
+				if recorder.Body.String() != `{"ok":true}` {
+					t.Errorf("expected upstream body, got %q", recorder.Body.String())
+				}
+				return
+			}
+			assertHeader(t, recorder.Result(), "Location", tc.expectedTarget)
+		})
+	}
+}
+
+func TestHeaderTriggersWithoutBody(t *testing.T) {
+	// Test that an upstream setting headers without writing anything is still checked and passed through
+	testCases := []struct {
+		name           string
+		headers        map[string]string
+		expectedCode   int
+		expectedTarget string
+	}{
+		{"trigger", map[string]string{"X-Redirect-Required": "true"}, 302, "http://login/"},
+		{"no trigger", map[string]string{"X-Upstream": "kept"}, 200, ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := redirecterrors.CreateConfig()
+			cfg.HeaderTriggers = []redirecterrors.HeaderTrigger{{Header: "X-Redirect-Required", Value: "true"}}
+			cfg.Target = "http://login/"
+
+			ctx := context.Background()
+			next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				for key, value := range tc.headers {
+					rw.Header().Set(key, value)
+				}
+			})
+
+			handler, err := redirecterrors.New(ctx, next, cfg, "redirecterrors-plugin")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			recorder := httptest.NewRecorder()
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost/app", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			handler.ServeHTTP(recorder, req)
+
+			resp := recorder.Result()
+			assertCode(t, resp, tc.expectedCode)
+			if len(tc.expectedTarget) == 0 {
+				assertNoHeader(t, resp, "Location")
+				assertHeader(t, resp, "X-Upstream", "kept")
+				return
+			}
+			assertHeader(t, resp, "Location", tc.expectedTarget)
+		})
+	}
+}
+
+func TestInvalidHeaderTrigger(t *testing.T) {
+	testCases := []struct {
+		name     string
+		trigger  redirecterrors.HeaderTrigger
+		expected string
+	}{
+		{"no header", redirecterrors.HeaderTrigger{Value: "true"}, "header trigger needs a header name"},
+		{"bad regex", redirecterrors.HeaderTrigger{Header: "X-Auth-Reason", Value: "regex:("}, "invalid header trigger pattern 'regex:('"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := redirecterrors.CreateConfig()
+			cfg.HeaderTriggers = []redirecterrors.HeaderTrigger{tc.trigger}
+			cfg.Target = "http://login/"
+
+			next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+			_, err := redirecterrors.New(context.Background(), next, cfg, "redirecterrors-plugin")
+			if err == nil || !strings.Contains(err.Error(), tc.expected) {
+				t.Errorf("expected error containing %q, got %v", tc.expected, err)
+			}
+		})
+	}
+}
+
+func TestTargetHeader(t *testing.T) {
+	testCases := []struct {
+		name     string
+		header   string
+		value    string
+		expected string
+	}{
+		{"location", "Location", "https://auth.example.com/?rd=x", "https://auth.example.com/?rd=x"},
+		{"custom header", "X-Login-Url", "https://auth.example.com/custom", "https://auth.example.com/custom"},
+		{"relative", "Location", "/login", "/login"},
+		{"missing", "X-Other", "https://auth.example.com/", "https://login.example.com/?rd=http://localhost/app"},
+		{"not allowed", "Location", "https://evil.com/", "https://login.example.com/?rd=http://localhost/app"},
+		{"scheme relative", "Location", "//evil.com/", "https://login.example.com/?rd=http://localhost/app"},
+		{"backslashes", "Location", "\\\\evil.com/", "https://login.example.com/?rd=http://localhost/app"},
+		{"javascript", "Location", "javascript:alert(1)", "https://login.example.com/?rd=http://localhost/app"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := redirecterrors.CreateConfig()
+			cfg.Status = []string{"401"}
+			cfg.Target = "https://login.example.com/?rd={url}"
+			cfg.TargetHeader = "location"
+			cfg.Rules = []redirecterrors.Rule{
+				{Status: []string{"403"}, Target: "https://login.example.com/denied", TargetHeader: "X-Login-Url"},
+			}
+			cfg.AllowedHosts = []string{"localhost", "*.example.com"}
+
+			status := 401
+			if tc.header == "X-Login-Url" {
+				status = 403
+			}
+
+			ctx := context.Background()
+			next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				rw.Header().Set(tc.header, tc.value)
+				rw.WriteHeader(status)
+			})
+
+			handler, err := redirecterrors.New(ctx, next, cfg, "redirecterrors-plugin")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			recorder := httptest.NewRecorder()
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost/app", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			handler.ServeHTTP(recorder, req)
+
+			assertCode(t, recorder.Result(), 302)
+			assertHeader(t, recorder.Result(), "Location", tc.expected)
+		})
+	}
+}
+
+func TestBodyMatch(t *testing.T) {
+	testCases := []struct {
+		name           string
+		status         int
+		body           string
+		expectedCode   int
+		expectedTarget string
+	}{
+		{"json pointer", 401, `{"error":"session_expired"}`, 302, "http://login/"},
+		{"json pointer no match", 401, `{"error":"invalid_token"}`, 401, ""},
+		{"nested pointer", 403, `{"errors":[{"code":42}]}`, 302, "http://denied/"},
+		{"pointer exists", 403, `{"errors":[]}`, 403, ""},
+		{"regex", 500, "upstream maintenance window", 302, "http://status/"},
+		{"not json", 401, "session_expired", 401, ""},
+		{"other status", 404, `{"error":"session_expired"}`, 404, ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := redirecterrors.CreateConfig()
+			cfg.Rules = []redirecterrors.Rule{
+				{Status: []string{"401"}, BodyMatch: &redirecterrors.BodyMatch{JSONPointer: "/error", Value: "session_expired"}, Target: "http://login/"},
+				{Status: []string{"403"}, BodyMatch: &redirecterrors.BodyMatch{JSONPointer: "/errors/0/code", Value: "42"}, Target: "http://denied/"},
+				{Status: []string{"5xx"}, BodyMatch: &redirecterrors.BodyMatch{Value: "regex:maintenance"}, Target: "http://status/"},
+			}
+
+			ctx := context.Background()
+			next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				rw.Header().Set("Content-Type", "application/json")
+				rw.Header().Set("Content-Length", fmt.Sprint(len(tc.body)))
+				rw.WriteHeader(tc.status)
+				// Write in two chunks to check the body is buffered as a whole
+				_, _ = rw.Write([]byte(tc.body[:len(tc.body)/2]))
+				_, _ = rw.Write([]byte(tc.body[len(tc.body)/2:]))
+			})
+
+			handler, err := redirecterrors.New(ctx, next, cfg, "redirecterrors-plugin")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			recorder := httptest.NewRecorder()
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost/app", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			handler.ServeHTTP(recorder, req)
+
+			assertCode(t, recorder.Result(), tc.expectedCode)
+			if len(tc.expectedTarget) != 0 {
+				assertHeader(t, recorder.Result(), "Location", tc.expectedTarget)
+				return
+			}
+
+			// The unmatched response is replayed unchanged
+			assertNoHeader(t, recorder.Result(), "Location")
+			assertHeader(t, recorder.Result(), "Content-Length", fmt.Sprint(len(tc.body)))
+			if recorder.Body.String() != tc.body {
+				t.Errorf("expected body %q, got %q", tc.body, recorder.Body.String())
+			}
+		})
+	}
+}
+
+func TestBodyMatchBufferLimit(t *testing.T) {
+	cfg := redirecterrors.CreateConfig()
+	cfg.Status = []string{"401"}
+	cfg.BodyMatch = &redirecterrors.BodyMatch{Value: "regex:session_expired"}
+	cfg.BodyBufferSize = 16
+	cfg.Target = "http://login/"
+
+	body := strings.Repeat("x", 20) + "session_expired"
+
+	ctx := context.Background()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(401)
+		_, _ = rw.Write([]byte(body[:10]))
+		_, _ = rw.Write([]byte(body[10:]))
+	})
+
+	handler, err := redirecterrors.New(ctx, next, cfg, "redirecterrors-plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost/app", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler.ServeHTTP(recorder, req)
+
+	// Too large to be matched, the response is streamed as is
+	assertCode(t, recorder.Result(), 401)
+	assertNoHeader(t, recorder.Result(), "Location")
+	if recorder.Body.String() != body {
+		t.Errorf("expected body %q, got %q", body, recorder.Body.String())
+	}
+}
+
+func TestInvalidBodyMatch(t *testing.T) {
+	testCases := []struct {
+		name     string
+		match    redirecterrors.BodyMatch
+		size     int
+		expected string
+	}{
+		{"empty", redirecterrors.BodyMatch{}, 1024, "body match needs a jsonPointer or a value"},
+		{"bad pointer", redirecterrors.BodyMatch{JSONPointer: "error"}, 1024, "invalid JSON pointer 'error'"},
+		{"bad regex", redirecterrors.BodyMatch{Value: "regex:("}, 1024, "invalid body match pattern 'regex:('"},
+		{"no buffer", redirecterrors.BodyMatch{Value: "x"}, 0, "bodyBufferSize must be positive"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := redirecterrors.CreateConfig()
+			cfg.Status = []string{"401"}
+			cfg.BodyMatch = &tc.match
+			cfg.BodyBufferSize = tc.size
+			cfg.Target = "http://login/"
+
+			next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+			_, err := redirecterrors.New(context.Background(), next, cfg, "redirecterrors-plugin")
+			if err == nil || !strings.Contains(err.Error(), tc.expected) {
+				t.Errorf("expected error containing %q, got %v", tc.expected, err)
+			}
+		})
+	}
+}
+
+func TestOutputCopyHeaders(t *testing.T) {
+	testCases := []struct {
+		name      string
+		mode      string
+		allowlist []string
+		copied    []string
+		notCopied []string
+	}{
+		{"all", "all", nil, []string{"X-Upstream", "Cache-Control", "Www-Authenticate"}, nil},
+		{"none", "none", nil, nil, []string{"X-Upstream", "Cache-Control", "Www-Authenticate"}},
+		{"allowlist", "allowlist", []string{"www-authenticate", "Content-Type"}, []string{"Www-Authenticate"}, []string{"X-Upstream", "Cache-Control"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := redirecterrors.CreateConfig()
+			cfg.Status = []string{"401"}
+			cfg.Target = "http://login/"
+			cfg.OutputCopyHeaders = tc.mode
+			cfg.OutputCopyHeadersAllowlist = tc.allowlist
+
+			ctx := context.Background()
+			next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				rw.Header().Set("X-Upstream", "value")
+				rw.Header().Set("Cache-Control", "no-cache")
+				rw.Header().Set("WWW-Authenticate", "Bearer")
+				rw.Header().Set("Content-Type", "application/json")
+				rw.Header().Set("Content-Length", "1532")
+				rw.Header().Set("Content-Encoding", "gzip")
+				rw.Header().Set("ETag", `"abc"`)
+				rw.Header().Set("Last-Modified", "Mon, 01 Jan 2024 00:00:00 GMT")
+				rw.WriteHeader(401)
+			})
+
+			handler, err := redirecterrors.New(ctx, next, cfg, "redirecterrors-plugin")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			recorder := httptest.NewRecorder()
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost/app", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			handler.ServeHTTP(recorder, req)
+			resp := recorder.Result()
+
+			assertCode(t, resp, 302)
+			for _, header := range tc.copied {
+				if resp.Header.Get(header) == "" {
+					t.Errorf("expected %s to be copied", header)
+				}
+			}
+			for _, header := range tc.notCopied {
+				assertNoHeader(t, resp, header)
+			}
+
+			// Entity headers describe the middleware's own body
+			assertNoHeader(t, resp, "Content-Encoding")
+			assertNoHeader(t, resp, "ETag")
+			assertNoHeader(t, resp, "Last-Modified")
+			assertHeader(t, resp, "Content-Type", "text/plain; charset=utf-8")
+			assertHeader(t, resp, "Content-Length", fmt.Sprint(recorder.Body.Len()))
+		})
+	}
+}
+
+func TestContentLengthOfOutputBodies(t *testing.T) {
+	testCases := []struct {
+		name        string
+		outputMode  string
+		accept      string
+		contentType string
+	}{
+		{"redirect", "redirect", "", "text/plain; charset=utf-8"},
+		{"html", "html", "", "text/html; charset=utf-8"},
+		{"problem", "redirect", "application/json", "application/problem+json"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := redirecterrors.CreateConfig()
+			cfg.Status = []string{"401"}
+			cfg.Target = "http://login/"
+			cfg.OutputMode = tc.outputMode
+			cfg.ProblemDetails = true
+
+			ctx := context.Background()
+			next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				rw.Header().Set("Content-Type", "application/xml")
+				rw.Header().Set("Content-Length", "1532")
+				rw.WriteHeader(401)
+			})
+
+			handler, err := redirecterrors.New(ctx, next, cfg, "redirecterrors-plugin")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			recorder := httptest.NewRecorder()
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost/app", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(tc.accept) != 0 {
+				req.Header.Set("Accept", tc.accept)
+			}
+
+			handler.ServeHTTP(recorder, req)
+			resp := recorder.Result()
+
+			assertHeader(t, resp, "Content-Type", tc.contentType)
+			assertHeader(t, resp, "Content-Length", fmt.Sprint(recorder.Body.Len()))
+		})
+	}
+}
+
+func TestInvalidOutputCopyHeaders(t *testing.T) {
+	testCases := []struct {
+		name      string
+		mode      string
+		allowlist []string
+		expected  string
+	}{
+		{"unknown mode", "some", nil, "invalid output copy headers mode 'some'"},
+		{"allowlist without mode", "all", []string{"X-Upstream"}, "outputCopyHeadersAllowlist needs outputCopyHeaders 'allowlist'"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := redirecterrors.CreateConfig()
+			cfg.Status = []string{"401"}
+			cfg.Target = "http://login/"
+			cfg.OutputCopyHeaders = tc.mode
+			cfg.OutputCopyHeadersAllowlist = tc.allowlist
+
+			next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+			_, err := redirecterrors.New(context.Background(), next, cfg, "redirecterrors-plugin")
+			if err == nil || !strings.Contains(err.Error(), tc.expected) {
+				t.Errorf("expected error containing %q, got %v", tc.expected, err)
+			}
+		})
+	}
+}
+
+func TestHeadRequestHasNoBody(t *testing.T) {
+	for _, outputMode := range []string{"redirect", "html"} {
+		t.Run(outputMode, func(t *testing.T) {
+			cfg := redirecterrors.CreateConfig()
+			cfg.Status = []string{"401"}
+			cfg.Target = "http://login/"
+			cfg.OutputMode = outputMode
+
+			ctx := context.Background()
+			next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				rw.WriteHeader(401)
+			})
+
+			handler, err := redirecterrors.New(ctx, next, cfg, "redirecterrors-plugin")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			recorder := httptest.NewRecorder()
+			req, err := http.NewRequestWithContext(ctx, http.MethodHead, "http://localhost/app", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			handler.ServeHTTP(recorder, req)
+
+			if outputMode == "redirect" {
+				assertCode(t, recorder.Result(), 302)
+				assertHeader(t, recorder.Result(), "Location", "http://login/")
+			} else {
+				assertCode(t, recorder.Result(), 200)
+			}
+			if recorder.Body.Len() != 0 {
+				t.Errorf("expected no body, got %q", recorder.Body.String())
+			}
+		})
+	}
+}
+
+func TestPreflightBypass(t *testing.T) {
+	testCases := []struct {
+		name            string
+		bypassPreflight bool
+		method          string
+		requestMethod   string
+		expectedCode    int
+	}{
+		{"preflight", true, http.MethodOptions, "POST", 401},
+		{"plain options", true, http.MethodOptions, "", 302},
+		{"preflight without bypass", false, http.MethodOptions, "POST", 302},
+		{"get", true, http.MethodGet, "POST", 302},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := redirecterrors.CreateConfig()
+			cfg.Status = []string{"401"}
+			cfg.Target = "http://login/"
+			cfg.BypassPreflight = tc.bypassPreflight
+
+			ctx := context.Background()
+			next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				rw.WriteHeader(401)
+			})
+
+			handler, err := redirecterrors.New(ctx, next, cfg, "redirecterrors-plugin")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			recorder := httptest.NewRecorder()
+			req, err := http.NewRequestWithContext(ctx, tc.method, "http://localhost/app", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Origin", "http://app.localhost")
+			if len(tc.requestMethod) != 0 {
+				req.Header.Set("Access-Control-Request-Method", tc.requestMethod)
+			}
+
+			handler.ServeHTTP(recorder, req)
+
+			assertCode(t, recorder.Result(), tc.expectedCode)
+		})
+	}
+}
+
+func TestOutputStatusAuto(t *testing.T) {
+	testCases := []struct {
+		name              string
+		method            string
+		contentType       string
+		autoUnsafeMethods string
+		expectedCode      int
+	}{
+		{"get", http.MethodGet, "", "redirect", 302},
+		{"head", http.MethodHead, "", "redirect", 302},
+		{"form post", http.MethodPost, "application/x-www-form-urlencoded", "redirect", 303},
+		{"multipart post", http.MethodPost, "multipart/form-data; boundary=x", "passthrough", 303},
+		{"json post", http.MethodPost, "application/json", "redirect", 307},
+		{"put", http.MethodPut, "application/json", "redirect", 307},
+		{"put passthrough", http.MethodPut, "application/json", "passthrough", 401},
+		{"delete passthrough", http.MethodDelete, "", "passthrough", 401},
+		{"get passthrough", http.MethodGet, "", "passthrough", 302},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := redirecterrors.CreateConfig()
+			cfg.Status = []string{"401"}
+			cfg.Target = "http://login/"
+			cfg.OutputStatus = "auto"
+			cfg.AutoUnsafeMethods = tc.autoUnsafeMethods
+
+			ctx := context.Background()
+			next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				rw.WriteHeader(401)
+			})
+
+			handler, err := redirecterrors.New(ctx, next, cfg, "redirecterrors-plugin")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			recorder := httptest.NewRecorder()
+			req, err := http.NewRequestWithContext(ctx, tc.method, "http://localhost/app", strings.NewReader("a=b"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(tc.contentType) != 0 {
+				req.Header.Set("Content-Type", tc.contentType)
+			}
+
+			handler.ServeHTTP(recorder, req)
+
+			assertCode(t, recorder.Result(), tc.expectedCode)
+		})
+	}
+}
+
+func TestRuleMethods(t *testing.T) {
+	cfg := redirecterrors.CreateConfig()
+	cfg.Rules = []redirecterrors.Rule{
+		{Status: []string{"401"}, Methods: []string{"get", "HEAD"}, Target: "http://login/"},
+		{Status: []string{"401"}, Methods: []string{"POST"}, Target: "http://login/form", OutputStatus: "auto"},
+	}
+
+	testCases := []struct {
+		method         string
+		expectedCode   int
+		expectedTarget string
+	}{
+		{http.MethodGet, 302, "http://login/"},
+		{http.MethodHead, 302, "http://login/"},
+		{http.MethodPost, 307, "http://login/form"},
+		{http.MethodPut, 401, ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.method, func(t *testing.T) {
+			ctx := context.Background()
+			next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				rw.WriteHeader(401)
+			})
+
+			handler, err := redirecterrors.New(ctx, next, cfg, "redirecterrors-plugin")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			recorder := httptest.NewRecorder()
+			req, err := http.NewRequestWithContext(ctx, tc.method, "http://localhost/app", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			handler.ServeHTTP(recorder, req)
+
+			assertCode(t, recorder.Result(), tc.expectedCode)
+			if len(tc.expectedTarget) != 0 {
+				assertHeader(t, recorder.Result(), "Location", tc.expectedTarget)
+			} else {
+				assertNoHeader(t, recorder.Result(), "Location")
+			}
+		})
+	}
+}
+
+func TestInvalidMethodConfig(t *testing.T) {
+	testCases := []struct {
+		name     string
+		modify   func(cfg *redirecterrors.Config)
+		expected string
+	}{
+		{"output status", func(cfg *redirecterrors.Config) { cfg.OutputStatus = "smart" }, "invalid output status 'smart'"},
+		{"rule output status", func(cfg *redirecterrors.Config) {
+			cfg.Rules = []redirecterrors.Rule{{Status: []string{"401"}, Target: "http://login/", OutputStatus: "99"}}
+		}, "invalid output status '99'"},
+		{"auto unsafe methods", func(cfg *redirecterrors.Config) { cfg.AutoUnsafeMethods = "drop" }, "invalid auto unsafe methods action 'drop'"},
+		{"method", func(cfg *redirecterrors.Config) { cfg.Methods = []string{"GET POST"} }, "invalid method 'GET POST'"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := redirecterrors.CreateConfig()
+			cfg.Status = []string{"401"}
+			cfg.Target = "http://login/"
+			tc.modify(cfg)
+
+			next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+			_, err := redirecterrors.New(context.Background(), next, cfg, "redirecterrors-plugin")
+			if err == nil || !strings.Contains(err.Error(), tc.expected) {
+				t.Errorf("expected error containing %q, got %v", tc.expected, err)
+			}
+		})
+	}
+}
+
+func TestReplayPost(t *testing.T) {
+	testCases := []struct {
+		name         string
+		contentType  string
+		body         string
+		headers      map[string]string
+		expectReplay bool
+	}{
+		{"form", "application/x-www-form-urlencoded", "comment=Hello+%3Cworld%3E&id=42&id=43", map[string]string{"Sec-Fetch-Site": "same-origin"}, true},
+		{"form origin", "application/x-www-form-urlencoded", "comment=Hello+%3Cworld%3E&id=42&id=43", map[string]string{"Origin": "https://example.com"}, true},
+		{"form referer", "application/x-www-form-urlencoded", "comment=Hello+%3Cworld%3E&id=42&id=43", map[string]string{"Referer": "https://example.com/comments"}, true},
+		{"cross-site", "application/x-www-form-urlencoded", "comment=Hello", map[string]string{"Sec-Fetch-Site": "cross-site", "Origin": "https://example.com"}, false},
+		{"cross-origin", "application/x-www-form-urlencoded", "comment=Hello", map[string]string{"Origin": "https://evil.com"}, false},
+		{"null origin", "application/x-www-form-urlencoded", "comment=Hello", map[string]string{"Origin": "null"}, false},
+		{"unknown origin", "application/x-www-form-urlencoded", "comment=Hello", map[string]string{}, false},
+		{"too large", "application/x-www-form-urlencoded", "comment=" + strings.Repeat("x", 64), map[string]string{"Sec-Fetch-Site": "same-origin"}, false},
+		{"json", "application/json", `{"comment":"Hello"}`, map[string]string{"Sec-Fetch-Site": "same-origin"}, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := redirecterrors.CreateConfig()
+			cfg.Status = []string{"401"}
+			cfg.Target = "http://login/?rd={return_url}"
+			cfg.ReturnCookieSecret = "secret"
+			cfg.ReplayPost = true
+			cfg.ReplayPostMaxSize = 48
+
+			var upstreamBody string
+			ctx := context.Background()
+			next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				body, _ := io.ReadAll(req.Body)
+				upstreamBody = string(body)
+				rw.WriteHeader(401)
+			})
+
+			handler, err := redirecterrors.New(ctx, next, cfg, "redirecterrors-plugin")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			recorder := httptest.NewRecorder()
+			req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://localhost/comments?page=2", strings.NewReader(tc.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Type", tc.contentType)
+			req.Header.Set("X-Forwarded-Proto", "https")
+			req.Header.Set("X-Forwarded-Host", "example.com")
+			for key, value := range tc.headers {
+				req.Header.Set(key, value)
+			}
+
+			handler.ServeHTTP(recorder, req)
+
+			// The upstream still gets the whole body
+			if upstreamBody != tc.body {
+				t.Errorf("expected upstream body %q, got %q", tc.body, upstreamBody)
+			}
+
+			resp := recorder.Result()
+			assertCode(t, resp, 302)
+
+			var returnCookie *http.Cookie
+			for _, cookie := range resp.Cookies() {
+				if cookie.Name == "redirecterrors_return" {
+					returnCookie = cookie
+				}
+			}
+			if returnCookie == nil {
+				t.Fatal("return cookie not set")
+			}
+
+			// Coming back from the login page
+			recorder = httptest.NewRecorder()
+			req, err = http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost/_redirecterrors/return", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.AddCookie(&http.Cookie{Name: returnCookie.Name, Value: returnCookie.Value})
+
+			handler.ServeHTTP(recorder, req)
+
+			resp = recorder.Result()
+			if !tc.expectReplay {
+				assertCode(t, resp, 302)
+				assertHeader(t, resp, "Location", "https://example.com/comments?page=2")
+				return
+			}
+
+			assertCode(t, resp, 200)
+			assertHeader(t, resp, "Content-Type", "text/html; charset=utf-8")
+			page := recorder.Body.String()
+			for _, expected := range []string{
+				`<form method="post" action="https://example.com/comments?page=2"`,
+				`<input type="hidden" name="comment" value="Hello &lt;world&gt;">`,
+				`<input type="hidden" name="id" value="42">`,
+				`<input type="hidden" name="id" value="43">`,
+			} {
+				if !strings.Contains(page, expected) {
+					t.Errorf("expected page to contain %q, got %q", expected, page)
+				}
+			}
+		})
+	}
+}
+
+func TestReplayPostWithoutReturnCookie(t *testing.T) {
+	cfg := redirecterrors.CreateConfig()
+	cfg.Status = []string{"401"}
+	cfg.Target = "http://login/"
+	cfg.ReplayPost = true
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+	_, err := redirecterrors.New(context.Background(), next, cfg, "redirecterrors-plugin")
+	if err == nil || !strings.Contains(err.Error(), "replayPost needs a return cookie secret") {
+		t.Errorf("expected return cookie error, got %v", err)
+	}
+}
+
+func TestStreamingRequests(t *testing.T) {
+	testCases := []struct {
+		name              string
+		streamingRequests string
+		headers           map[string]string
+		expectedCode      int
+		expectedType      string
+	}{
+		{"websocket passthrough", "passthrough", map[string]string{"Connection": "Upgrade", "Upgrade": "websocket"}, 401, ""},
+		{"event stream passthrough", "passthrough", map[string]string{"Accept": "text/event-stream"}, 401, ""},
+		{"websocket json", "json", map[string]string{"Connection": "Upgrade", "Upgrade": "WebSocket"}, 401, "application/problem+json"},
+		{"event stream close", "close", map[string]string{"Accept": "text/html, text/event-stream;q=0.9"}, 401, ""},
+		{"regular request", "passthrough", map[string]string{"Accept": "text/html"}, 302, ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := redirecterrors.CreateConfig()
+			cfg.Status = []string{"401"}
+			cfg.Target = "http://login/"
+			cfg.StreamingRequests = tc.streamingRequests
+
+			ctx := context.Background()
+			next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				rw.Header().Set("X-Upstream", "value")
+				rw.WriteHeader(401)
+			})
+
+			handler, err := redirecterrors.New(ctx, next, cfg, "redirecterrors-plugin")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			recorder := httptest.NewRecorder()
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost/events", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for key, value := range tc.headers {
+				req.Header.Set(key, value)
+			}
+
+			handler.ServeHTTP(recorder, req)
+			resp := recorder.Result()
+
+			assertCode(t, resp, tc.expectedCode)
+			if len(tc.expectedType) != 0 {
+				assertHeader(t, resp, "Content-Type", tc.expectedType)
+			}
+			if tc.streamingRequests == "close" {
+				assertHeader(t, resp, "Connection", "close")
+				if recorder.Body.Len() != 0 {
+					t.Errorf("expected no body, got %q", recorder.Body.String())
+				}
+			}
+			if tc.expectedCode != 302 {
+				assertNoHeader(t, resp, "Location")
+			}
+		})
+	}
+}
+
+func TestHijackUpgradedConnection(t *testing.T) {
+	cfg := redirecterrors.CreateConfig()
+	cfg.Status = []string{"401"}
+	cfg.Target = "http://login/"
+	// Keep the code catcher in the path of streaming requests
+	cfg.StreamingRequests = "json"
+
+	hijackErrors := make(chan error, 1)
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/denied" {
+			rw.WriteHeader(401)
+		}
+
+		conn, buf, err := rw.(http.Hijacker).Hijack()
+		hijackErrors <- err
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		_ = buf.Flush()
+	})
+
+	handler, err := redirecterrors.New(context.Background(), next, cfg, "redirecterrors-plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	testCases := []struct {
+		path         string
+		expectedLine string
+		hijacked     bool
+	}{
+		{"/socket", "HTTP/1.1 101 Switching Protocols", true},
+		{"/denied", "HTTP/1.1 401 Unauthorized", false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.path, func(t *testing.T) {
+			conn, err := net.Dial("tcp", server.Listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			_, err = fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n", tc.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			line, err := bufio.NewReader(conn).ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.TrimSpace(line) != tc.expectedLine {
+				t.Errorf("expected %q, got %q", tc.expectedLine, strings.TrimSpace(line))
+			}
+
+			// A caught response cannot be hijacked, the middleware answers it
+			if err := <-hijackErrors; (err == nil) != tc.hijacked {
+				t.Errorf("unexpected hijack error %v", err)
+			}
+		})
+	}
+}
+
+func TestInvalidStreamingRequests(t *testing.T) {
+	cfg := redirecterrors.CreateConfig()
+	cfg.Status = []string{"401"}
+	cfg.Target = "http://login/"
+	cfg.StreamingRequests = "drop"
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+	_, err := redirecterrors.New(context.Background(), next, cfg, "redirecterrors-plugin")
+	if err == nil || !strings.Contains(err.Error(), "invalid streaming requests action 'drop'") {
+		t.Errorf("expected invalid streaming requests error, got %v", err)
+	}
+}
+
+func TestTargetHeaderWithoutAllowedHosts(t *testing.T) {
+	cfg := redirecterrors.CreateConfig()
+	cfg.Status = []string{"401"}
+	cfg.Target = "https://login.example.com/"
+	cfg.Rules = []redirecterrors.Rule{
+		{Status: []string{"403"}, Target: "https://login.example.com/denied", TargetHeader: "X-Login-Url"},
+	}
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+	_, err := redirecterrors.New(context.Background(), next, cfg, "redirecterrors-plugin")
+	if err == nil || !strings.Contains(err.Error(), "targetHeader needs allowedHosts") {
+		t.Errorf("expected allowedHosts error, got %v", err)
+	}
+}
+
+func TestRuleOutputStatusOverridesAutoMode(t *testing.T) {
+	cfg := redirecterrors.CreateConfig()
+	cfg.OutputStatus = "auto"
+	cfg.Rules = []redirecterrors.Rule{
+		{Status: []string{"401"}, Target: "http://login/", OutputStatus: "307"},
+		{Status: []string{"403"}, Target: "http://denied/"},
+		{Status: []string{"404"}, Target: "http://missing/", OutputStatus: "auto"},
+	}
+
+	testCases := []struct {
+		status       int
+		method       string
+		expectedCode int
+	}{
+		{401, http.MethodGet, 307},
+		{403, http.MethodGet, 302},
+		{403, http.MethodPut, 307},
+		{404, http.MethodGet, 302},
+	}
+
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%d_%s", tc.status, tc.method), func(t *testing.T) {
+			ctx := context.Background()
+			next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				rw.WriteHeader(tc.status)
+			})
+
+			handler, err := redirecterrors.New(ctx, next, cfg, "redirecterrors-plugin")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			recorder := httptest.NewRecorder()
+			req, err := http.NewRequestWithContext(ctx, tc.method, "http://localhost/app", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			handler.ServeHTTP(recorder, req)
+
+			assertCode(t, recorder.Result(), tc.expectedCode)
+		})
+	}
+}
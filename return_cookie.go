@@ -0,0 +1,199 @@
+package redirecterrors
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// errInvalidSealedValue is returned when a sealed value cannot be opened.
+var errInvalidSealedValue = errors.New("invalid sealed value")
+
+// sealer encrypts and authenticates small values with AES-GCM,
+// using a key derived from a configured secret.
+type sealer struct {
+	aead cipher.AEAD
+}
+
+func newSealer(secret string) (*sealer, error) {
+	key := sha256.Sum256([]byte(secret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &sealer{aead: aead}, nil
+}
+
+// seal encrypts plaintext, binding it to context, and returns it base64url-encoded.
+func (s *sealer) seal(plaintext, context []byte) (string, error) {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := s.aead.Seal(nonce, nonce, plaintext, context)
+	return base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// open decrypts a value produced by seal with the same context.
+func (s *sealer) open(value string, context []byte) ([]byte, error) {
+	sealed, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(sealed) < s.aead.NonceSize() {
+		return nil, errInvalidSealedValue
+	}
+	nonce, ciphertext := sealed[:s.aead.NonceSize()], sealed[s.aead.NonceSize():]
+	plaintext, err := s.aead.Open(nil, nonce, ciphertext, context)
+	if err != nil {
+		return nil, errInvalidSealedValue
+	}
+	return plaintext, nil
+}
+
+// returnState the content of the return cookie.
+// Body holds the URL-encoded form POSTed to URL, to be replayed after re-authentication.
+type returnState struct {
+	URL     string `json:"u"`
+	Body    string `json:"b,omitempty"`
+	Expires int64  `json:"e"`
+}
+
+// returnCookie stores the original URL in an encrypted cookie when the redirect fires,
+// and restores it when the client comes back on the return path.
+type returnCookie struct {
+	sealer *sealer
+	name   string
+	domain string
+	path   string
+	ttl    time.Duration
+}
+
+// newReturnCookie creates the return cookie handling from its configuration.
+// It returns nil when no secret is configured.
+func newReturnCookie(config *Config) (*returnCookie, error) {
+	secret, err := loadSecret(config.ReturnCookieSecret, config.ReturnCookieSecretFile)
+	if err != nil {
+		return nil, fmt.Errorf("return cookie secret: %w", err)
+	}
+	if len(secret) == 0 {
+		return nil, nil
+	}
+
+	if len(config.ReturnCookieName) == 0 {
+		return nil, fmt.Errorf("return cookie name must be set")
+	}
+	if len(config.ReturnPath) == 0 || config.ReturnPath[0] != '/' {
+		return nil, fmt.Errorf("return path must start with '/'")
+	}
+
+	ttl, err := time.ParseDuration(config.ReturnCookieTTL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid return cookie ttl '%s': %w", config.ReturnCookieTTL, err)
+	}
+	if ttl <= 0 {
+		return nil, fmt.Errorf("return cookie ttl must be positive")
+	}
+
+	s, err := newSealer(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	return &returnCookie{
+		sealer: s,
+		name:   config.ReturnCookieName,
+		domain: config.ReturnCookieDomain,
+		path:   config.ReturnPath,
+		ttl:    ttl,
+	}, nil
+}
+
+// build returns the Set-Cookie value storing rawURL and, if not empty, the form body to replay.
+func (rc *returnCookie) build(rawURL, body string, now time.Time) (string, error) {
+	// Form bodies are full of '&', keep them compact
+	var plaintext bytes.Buffer
+	encoder := json.NewEncoder(&plaintext)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(returnState{URL: rawURL, Body: body, Expires: now.Add(rc.ttl).Unix()}); err != nil {
+		return "", err
+	}
+	value, err := rc.sealer.seal(plaintext.Bytes(), []byte(rc.name))
+	if err != nil {
+		return "", err
+	}
+	return rc.cookie(value, int(rc.ttl.Seconds())), nil
+}
+
+// deletion returns the Set-Cookie value clearing the return cookie.
+func (rc *returnCookie) deletion() string {
+	return rc.cookie("", 0)
+}
+
+func (rc *returnCookie) cookie(value string, maxAge int) string {
+	cookie := rc.name + "=" + value + "; Path=/; Max-Age=" + strconv.Itoa(maxAge)
+	if len(rc.domain) != 0 {
+		cookie += "; Domain=" + rc.domain
+	}
+	return cookie + "; HttpOnly; Secure; SameSite=Lax"
+}
+
+// restore returns the state stored in the request's return cookie.
+func (rc *returnCookie) restore(req *http.Request, now time.Time) (returnState, error) {
+	var state returnState
+	cookie, err := req.Cookie(rc.name)
+	if err != nil {
+		return state, err
+	}
+
+	plaintext, err := rc.sealer.open(cookie.Value, []byte(rc.name))
+	if err != nil {
+		return state, err
+	}
+
+	if err := json.Unmarshal(plaintext, &state); err != nil {
+		return state, errInvalidSealedValue
+	}
+	if now.Unix() > state.Expires {
+		return state, fmt.Errorf("return cookie expired")
+	}
+	return state, nil
+}
+
+// serveReturn answers the return path by redirecting to the URL stored in the return cookie,
+// or by resubmitting the form stored along with it.
+func (a *RedirectErrors) serveReturn(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Add("Set-Cookie", a.returnCookie.deletion())
+
+	state, err := a.returnCookie.restore(req, time.Now())
+	location := state.URL
+	if err == nil && !a.allowedHosts.allowsURL(location) {
+		err = fmt.Errorf("host not allowed")
+	}
+	if err != nil {
+		a.logger.info("invalid return cookie", "error", err.Error(), "request_id", req.Header.Get("X-Request-Id"))
+		if len(a.fallbackURL) == 0 {
+			writeText(rw, http.StatusBadRequest, "Invalid return cookie")
+			return
+		}
+		location = a.fallbackURL
+	} else if len(state.Body) != 0 {
+		a.logger.info("replaying form", "target", location, "request_id", req.Header.Get("X-Request-Id"))
+		writeReplayForm(rw, location, state.Body)
+		return
+	}
+
+	rw.Header().Set("Location", location)
+	writeText(rw, http.StatusFound, defaultBody)
+}
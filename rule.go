@@ -0,0 +1,197 @@
+package redirecterrors
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Rule the configuration of a single redirect rule.
+// Rules are checked in order and the first one matching the caught status or one of its header triggers wins.
+type Rule struct {
+	Name           string          `json:"name,omitempty"`
+	Status         []string        `json:"status,omitempty"`
+	HeaderTriggers []HeaderTrigger `json:"headerTriggers,omitempty"`
+	BodyMatch      *BodyMatch      `json:"bodyMatch,omitempty"`
+	Target         string          `json:"target,omitempty"`
+	TargetHeader   string          `json:"targetHeader,omitempty"`
+	OutputStatus   string          `json:"outputStatus,omitempty"`
+	Methods        []string        `json:"methods,omitempty"`
+	IncludePaths   []string        `json:"includePaths,omitempty"`
+	ExcludePaths   []string        `json:"excludePaths,omitempty"`
+}
+
+// redirectRule a compiled redirect rule.
+type redirectRule struct {
+	name           string
+	httpCodeRanges HTTPCodeRanges
+	headerTriggers []*headerTrigger
+	bodyMatcher    *bodyMatcher
+	paths          *pathMatcher
+	target         *template
+	targetHeader   string
+	outputStatus   int
+	autoStatus     bool
+	methods        map[string]bool
+}
+
+// newRedirectRule compiles a rule, using the defaults of the top-level configuration when the rule does not set them.
+func newRedirectRule(rule Rule, defaults *Config) (*redirectRule, error) {
+	if len(rule.Target) == 0 {
+		return nil, fmt.Errorf("target url must be set")
+	}
+
+	target, err := compileTemplate(rule.Target)
+	if err != nil {
+		return nil, err
+	}
+
+	httpCodeRanges, err := NewHTTPCodeRanges(rule.Status)
+	if err != nil {
+		return nil, err
+	}
+
+	headerTriggers, err := newHeaderTriggers(rule.HeaderTriggers)
+	if err != nil {
+		return nil, err
+	}
+
+	bodyMatcher, err := newBodyMatcher(rule.BodyMatch)
+	if err != nil {
+		return nil, err
+	}
+
+	paths, err := newPathMatcher(rule.IncludePaths, rule.ExcludePaths)
+	if err != nil {
+		return nil, err
+	}
+
+	methods, err := newMethodSet(rule.Methods)
+	if err != nil {
+		return nil, err
+	}
+
+	// A rule setting its own status keeps it, whatever the top-level status
+	rawOutputStatus := rule.OutputStatus
+	if len(rawOutputStatus) == 0 {
+		rawOutputStatus = defaults.OutputStatus
+	}
+	outputStatus, autoStatus, err := parseOutputStatus(rawOutputStatus)
+	if err != nil {
+		return nil, err
+	}
+
+	targetHeader := rule.TargetHeader
+	if len(targetHeader) == 0 {
+		targetHeader = defaults.TargetHeader
+	}
+
+	return &redirectRule{
+		name:           rule.Name,
+		httpCodeRanges: httpCodeRanges,
+		headerTriggers: headerTriggers,
+		bodyMatcher:    bodyMatcher,
+		paths:          paths,
+		target:         target,
+		targetHeader:   http.CanonicalHeaderKey(targetHeader),
+		outputStatus:   outputStatus,
+		autoStatus:     autoStatus,
+		methods:        methods,
+	}, nil
+}
+
+// newRedirectRules compiles the configured rules followed by the top-level Status/Target rule, if any.
+func newRedirectRules(config *Config) ([]*redirectRule, error) {
+	var rules []*redirectRule
+	for i, rule := range config.Rules {
+		compiled, err := newRedirectRule(rule, config)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i, err)
+		}
+		if len(compiled.name) == 0 {
+			compiled.name = fmt.Sprintf("rule-%d", i)
+		}
+		rules = append(rules, compiled)
+	}
+
+	if len(config.Target) != 0 || len(rules) == 0 {
+		compiled, err := newRedirectRule(Rule{
+			Name:           "default",
+			Status:         config.Status,
+			HeaderTriggers: config.HeaderTriggers,
+			BodyMatch:      config.BodyMatch,
+			Target:         config.Target,
+			OutputStatus:   config.OutputStatus,
+			Methods:        config.Methods,
+		}, config)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, compiled)
+	} else if len(config.Status) != 0 || len(config.HeaderTriggers) != 0 || config.BodyMatch != nil {
+		return nil, fmt.Errorf("target url must be set")
+	}
+
+	return rules, nil
+}
+
+// applicableRules returns the rules whose path patterns and methods match the request.
+func applicableRules(rules []*redirectRule, req *http.Request) []*redirectRule {
+	var applicable []*redirectRule
+	for _, rule := range rules {
+		if rule.paths.matches(req.URL.Path) && (rule.methods == nil || rule.methods[req.Method]) {
+			applicable = append(applicable, rule)
+		}
+	}
+	return applicable
+}
+
+// outputStatusFor returns the status of the redirect for the request.
+func (r *redirectRule) outputStatusFor(req *http.Request) int {
+	if r.autoStatus {
+		return autoOutputStatus(req)
+	}
+	return r.outputStatus
+}
+
+// rulesHTTPCodeRanges returns the union of the status ranges of the rules.
+func rulesHTTPCodeRanges(rules []*redirectRule) HTTPCodeRanges {
+	var httpCodeRanges HTTPCodeRanges
+	for _, rule := range rules {
+		httpCodeRanges = httpCodeRanges.Union(rule.httpCodeRanges)
+	}
+	return httpCodeRanges
+}
+
+// rulesHeaderTriggers returns the header triggers of all the rules.
+func rulesHeaderTriggers(rules []*redirectRule) []*headerTrigger {
+	var headerTriggers []*headerTrigger
+	for _, rule := range rules {
+		headerTriggers = append(headerTriggers, rule.headerTriggers...)
+	}
+	return headerTriggers
+}
+
+// rulesWithBodyMatch returns the rules having a body match.
+func rulesWithBodyMatch(rules []*redirectRule) []*redirectRule {
+	var bodyRules []*redirectRule
+	for _, rule := range rules {
+		if rule.bodyMatcher != nil {
+			bodyRules = append(bodyRules, rule)
+		}
+	}
+	return bodyRules
+}
+
+// matchRule returns the first rule whose status ranges contain code or whose header triggers match headers,
+// and whose body match, if any, matches body, or nil.
+func matchRule(rules []*redirectRule, code int, headers http.Header, body []byte) *redirectRule {
+	for _, rule := range rules {
+		if !rule.httpCodeRanges.Contains(code) && !anyHeaderTriggerMatches(rule.headerTriggers, headers) {
+			continue
+		}
+		if rule.bodyMatcher == nil || rule.bodyMatcher.matches(body) {
+			return rule
+		}
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package redirecterrors
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// signaturePlaceholders the placeholders whose value depends on the signing secret.
+var signaturePlaceholders = []string{"signed_url", "exp", "sig"}
+
+// urlSigner signs reconstructed original URLs so that the auth portal can check
+// that a return URL really came from the proxy.
+type urlSigner struct {
+	key []byte
+	ttl time.Duration
+}
+
+// newURLSigner creates a signer from a secret or a secret file.
+// It returns nil when no secret is configured.
+func newURLSigner(secret, secretFile, ttl string) (*urlSigner, error) {
+	secret, err := loadSecret(secret, secretFile)
+	if err != nil {
+		return nil, fmt.Errorf("signing secret: %w", err)
+	}
+	if len(secret) == 0 {
+		return nil, nil
+	}
+
+	duration, err := time.ParseDuration(ttl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature ttl '%s': %w", ttl, err)
+	}
+	if duration <= 0 {
+		return nil, fmt.Errorf("signature ttl must be positive")
+	}
+
+	return &urlSigner{
+		key: []byte(secret),
+		ttl: duration,
+	}, nil
+}
+
+// loadSecret returns the inline secret, or the trimmed content of secretFile.
+func loadSecret(secret, secretFile string) (string, error) {
+	if len(secret) != 0 && len(secretFile) != 0 {
+		return "", fmt.Errorf("secret and secret file are mutually exclusive")
+	}
+	if len(secretFile) == 0 {
+		return secret, nil
+	}
+
+	content, err := os.ReadFile(secretFile)
+	if err != nil {
+		return "", err
+	}
+	secret = strings.TrimSpace(string(content))
+	if len(secret) == 0 {
+		return "", fmt.Errorf("secret file '%s' is empty", secretFile)
+	}
+	return secret, nil
+}
+
+// sign returns the expiry (Unix seconds) and signature of rawURL:
+// the unpadded base64url HMAC-SHA256 of the URL and the expiry, separated by a newline.
+func (s *urlSigner) sign(rawURL string, now time.Time) (exp, sig string) {
+	exp = strconv.FormatInt(now.Add(s.ttl).Unix(), 10)
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(rawURL))
+	mac.Write([]byte{'\n'})
+	mac.Write([]byte(exp))
+	return exp, base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
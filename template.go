@@ -0,0 +1,229 @@
+package redirecterrors
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// placeholderNames the placeholders available in every template.
+// header, cookie and query take an argument, e.g. {header:X-Tenant};
+// query is also valid without one.
+var placeholderNames = map[string]bool{
+	"status":     true,
+	"url":        true,
+	"uri":        true,
+	"proto":      true,
+	"host":       true,
+	"path":       true,
+	"query":      true,
+	"method":     true,
+	"remote_ip":  true,
+	"request_id": true,
+	"signed_url": true,
+	"exp":        true,
+	"sig":        true,
+	"return_url": true,
+}
+
+// placeholderNamesWithArg the placeholders taking an argument.
+var placeholderNamesWithArg = map[string]bool{
+	"header": true,
+	"cookie": true,
+	"query":  true,
+}
+
+// filterFuncs the filters available in placeholder pipelines, e.g. {url|query}.
+// default takes an argument and is handled separately.
+var filterFuncs = map[string]func(string) string{
+	"query":     url.QueryEscape,
+	"path":      url.PathEscape,
+	"base64url": func(s string) string { return base64.RawURLEncoding.EncodeToString([]byte(s)) },
+	"lower":     strings.ToLower,
+	"upper":     strings.ToUpper,
+}
+
+// templateFilter a filter of a placeholder pipeline.
+type templateFilter struct {
+	name string
+	arg  string
+}
+
+func (f templateFilter) apply(value string) string {
+	if f.name == "default" {
+		if len(value) == 0 {
+			return f.arg
+		}
+		return value
+	}
+	return filterFuncs[f.name](value)
+}
+
+// templateSegment a literal text or a placeholder with its filters.
+type templateSegment struct {
+	literal string
+	raw     string
+	name    string
+	arg     string
+	filters []templateFilter
+}
+
+// template a target or body compiled once into segments.
+type template struct {
+	segments []templateSegment
+}
+
+// compileTemplate parses text into literal and placeholder segments.
+// A placeholder is written {name}, {name:arg} and may be followed by filters: {name|filter|filter:arg}.
+// A '{' not followed by a lowercase letter is literal text, so JSON bodies need no escaping.
+// Unknown placeholders and unterminated braces are errors; see compileBodyTemplate for bodies.
+func compileTemplate(text string) (*template, error) {
+	return compile(text, false, nil)
+}
+
+// compileBodyTemplate is compileTemplate for response bodies, where CSS rules such as p{color:red}
+// and scripts such as function(){return x} are common: unknown placeholders and unterminated braces
+// are kept as literal text. extraNames are body-specific placeholders, such as "location".
+func compileBodyTemplate(text string, extraNames ...string) (*template, error) {
+	return compile(text, true, extraNames)
+}
+
+func compile(text string, lenient bool, extraNames []string) (*template, error) {
+	t := &template{}
+	var literal strings.Builder
+
+	for len(text) != 0 {
+		start := strings.IndexByte(text, '{')
+		if start < 0 || start+1 >= len(text) || text[start+1] < 'a' || text[start+1] > 'z' {
+			if start < 0 {
+				literal.WriteString(text)
+				break
+			}
+			literal.WriteString(text[:start+1])
+			text = text[start+1:]
+			continue
+		}
+
+		end := strings.IndexByte(text[start:], '}')
+		if end < 0 {
+			if lenient {
+				literal.WriteString(text)
+				break
+			}
+			return nil, fmt.Errorf("unterminated placeholder '%s'", text[start:])
+		}
+		end += start
+
+		raw := text[start : end+1]
+		if lenient && !isPlaceholderName(raw, extraNames) {
+			// Only the brace is literal, a placeholder may follow before the closing one
+			literal.WriteString(text[:start+1])
+			text = text[start+1:]
+			continue
+		}
+
+		segment, err := parsePlaceholder(raw, extraNames)
+		if err != nil {
+			return nil, err
+		}
+
+		literal.WriteString(text[:start])
+		if literal.Len() != 0 {
+			t.segments = append(t.segments, templateSegment{literal: literal.String()})
+			literal.Reset()
+		}
+		t.segments = append(t.segments, segment)
+		text = text[end+1:]
+	}
+
+	if literal.Len() != 0 {
+		t.segments = append(t.segments, templateSegment{literal: literal.String()})
+	}
+	return t, nil
+}
+
+// isPlaceholderName returns whether the placeholder, including its braces, has a known name and argument.
+// An empty argument, as in {query:}, is never valid.
+func isPlaceholderName(raw string, extraNames []string) bool {
+	nameAndArg, _, _ := strings.Cut(raw[1:len(raw)-1], "|")
+	name, arg, hasArg := strings.Cut(nameAndArg, ":")
+	if hasArg && len(arg) == 0 {
+		return false
+	}
+	if placeholderNames[name] && !hasArg || placeholderNamesWithArg[name] && hasArg {
+		return true
+	}
+	for _, extraName := range extraNames {
+		if name == extraName && !hasArg {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePlaceholder parses a placeholder, including its braces.
+func parsePlaceholder(raw string, extraNames []string) (templateSegment, error) {
+	parts := strings.Split(raw[1:len(raw)-1], "|")
+	segment := templateSegment{raw: raw}
+
+	segment.name, segment.arg, _ = strings.Cut(parts[0], ":")
+	if !isPlaceholderName(raw, extraNames) {
+		return segment, fmt.Errorf("unknown placeholder '%s'", raw)
+	}
+
+	for _, part := range parts[1:] {
+		name, arg, hasArg := strings.Cut(part, ":")
+		_, ok := filterFuncs[name]
+		switch {
+		case name == "default":
+			if len(arg) == 0 {
+				return segment, fmt.Errorf("filter 'default' needs an argument in placeholder '%s'", raw)
+			}
+		case !ok:
+			return segment, fmt.Errorf("unknown filter '%s' in placeholder '%s'", name, raw)
+		case hasArg:
+			return segment, fmt.Errorf("filter '%s' takes no argument in placeholder '%s'", name, raw)
+		}
+		segment.filters = append(segment.filters, templateFilter{name: name, arg: arg})
+	}
+	return segment, nil
+}
+
+// uses returns whether the template contains any of the named placeholders.
+func (t *template) uses(names ...string) bool {
+	for _, segment := range t.segments {
+		for _, name := range names {
+			if len(segment.raw) != 0 && segment.name == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// render expands the template. Placeholders without a value are written as is.
+// escape, if not nil, is applied to every value after its filters.
+func (t *template) render(p placeholders, escape func(string) string) string {
+	var sb strings.Builder
+	for _, segment := range t.segments {
+		if len(segment.raw) == 0 {
+			sb.WriteString(segment.literal)
+			continue
+		}
+
+		value, ok := p.lookup(segment.name, segment.arg)
+		if !ok {
+			sb.WriteString(segment.raw)
+			continue
+		}
+		for _, filter := range segment.filters {
+			value = filter.apply(value)
+		}
+		if escape != nil {
+			value = escape(value)
+		}
+		sb.WriteString(value)
+	}
+	return sb.String()
+}
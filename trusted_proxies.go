@@ -0,0 +1,98 @@
+package redirecterrors
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// trustedProxies holds the networks of the proxies whose forwarded headers are honored.
+// Entries are CIDR ranges or single IP addresses.
+// An empty list trusts every client for the original URL, as forwarded headers were always honored
+// before it existed, but never for the client IP.
+type trustedProxies struct {
+	networks []*net.IPNet
+}
+
+func newTrustedProxies(entries []string) (*trustedProxies, error) {
+	proxies := &trustedProxies{}
+	for _, entry := range entries {
+		cidr := strings.TrimSpace(entry)
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy '%s'", entry)
+			}
+			proxies.networks = append(proxies.networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy '%s': %w", entry, err)
+		}
+		proxies.networks = append(proxies.networks, network)
+	}
+	return proxies, nil
+}
+
+func (t *trustedProxies) isEmpty() bool {
+	return len(t.networks) == 0
+}
+
+// contains returns whether the IP address belongs to a trusted proxy.
+func (t *trustedProxies) contains(rawIP string) bool {
+	ip := net.ParseIP(rawIP)
+	if ip == nil {
+		return false
+	}
+	for _, network := range t.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// trusts returns whether the forwarded headers of the request are honored,
+// i.e. whether it comes straight from a trusted proxy.
+func (t *trustedProxies) trusts(req *http.Request) bool {
+	return t.isEmpty() || t.contains(stripPort(req.RemoteAddr))
+}
+
+// clientIP returns the IP address of the client.
+// Without trusted proxies, any client could spoof the forwarded headers, so it is the connection address.
+// Otherwise, X-Forwarded-For, or the Forwarded "for" nodes, are walked from the right,
+// skipping trusted hops, up to the first address not belonging to a trusted proxy.
+func (t *trustedProxies) clientIP(req *http.Request) string {
+	remoteIP := stripPort(req.RemoteAddr)
+
+	if t.isEmpty() || !t.contains(remoteIP) {
+		return remoteIP
+	}
+
+	var hops []string
+	for _, header := range req.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(header, ",") {
+			hops = append(hops, stripPort(strings.TrimSpace(hop)))
+		}
+	}
+	if len(hops) == 0 {
+		for _, element := range parseForwardedElements(req.Header.Values("Forwarded")) {
+			hops = append(hops, forwardedNodeIP(element["for"]))
+		}
+	}
+
+	clientIP := remoteIP
+	for i := len(hops) - 1; i >= 0; i-- {
+		if net.ParseIP(hops[i]) == nil {
+			// Obfuscated or garbled hop, nothing beyond it can be relied on
+			break
+		}
+		clientIP = hops[i]
+		if !t.contains(clientIP) {
+			break
+		}
+	}
+	return clientIP
+}